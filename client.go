@@ -2,9 +2,11 @@ package pinpin
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -13,120 +15,315 @@ import (
 	"os"
 	"sync"
 	"time"
-
-	"github.com/schollz/progressbar/v3"
 )
 
-func DialTimeout(address string, timeout time.Duration) (*Conn, error) {
-	log := slog.Default()
-	log.Debug("connecting", "address", address)
-	conn, err := net.DialTimeout("tcp", address, timeout)
+// ErrConnBroken is returned when the connection is out of sync with the
+// Merlin, e.g. after an exchange interrupted halfway by its context, and by
+// every following exchange.
+var ErrConnBroken = errors.New("connection out of sync with the Merlin")
+
+func DialTimeout(address string, timeout time.Duration, opts ...Option) (*Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return DialContext(ctx, address, opts...)
+}
+
+func DialContext(ctx context.Context, address string, opts ...Option) (*Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Debug("connected")
-	return &Conn{
-		conn: conn,
-		log:  log,
-	}, nil
+	c := NewConn(conn, opts...)
+	c.log.Debug("connected", "address", address)
+	return c, nil
+}
+
+// NewConn speaks the Merlin protocol over `rw`. If `rw` has a `SetDeadline`
+// method, like `net.Conn`, it is used to honour contexts; otherwise `rw` is
+// closed to interrupt an exchange whose context is done.
+func NewConn(rw io.ReadWriteCloser, opts ...Option) *Conn {
+	c := &Conn{
+		conn:     rw,
+		sem:      make(chan struct{}, 1),
+		log:      slog.Default(),
+		progress: nopProgressReporter{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	c.enc = NewFrameEncoder(c.conn)
+	c.dec = NewFrameDecoder(c.conn)
+	return c
 }
 
 type Conn struct {
-	conn net.Conn
-	mu   sync.Mutex
-	log  *slog.Logger
+	conn     io.ReadWriteCloser
+	enc      *FrameEncoder
+	dec      *FrameDecoder
+	sem      chan struct{}
+	log      *slog.Logger
+	progress ProgressReporter
+	// ioTimeout is set by WithIOTimeout
+	ioTimeout *ioTimeoutConn
+
+	// mu guards broken, the error returned by every exchange once the
+	// connection is out of sync
+	mu     sync.Mutex
+	broken error
 }
 
-func (c *Conn) Close() error {
-	return c.conn.Close()
+type deadliner interface {
+	SetDeadline(t time.Time) error
 }
 
-func (c *Conn) writedMsg(msg []byte) error {
-	if len(msg) < 1 {
-		panic("expected message with at least a command, got none")
-	} else if len(msg) > math.MaxUint8 {
-		panic("expected message length to be encodable in a byte")
+type Option func(c *Conn)
+
+// WithLogger logs the exchanges to `log` instead of `slog.Default()`.
+func WithLogger(log *slog.Logger) Option {
+	return func(c *Conn) {
+		c.log = log
+	}
+}
+
+// WithProgressReporter reports the progress of file transfers to `p`. By
+// default, nothing is reported.
+func WithProgressReporter(p ProgressReporter) Option {
+	return func(c *Conn) {
+		c.progress = p
 	}
+}
 
-	buf := make([]byte, 1+len(msg)+4)
-	buf[0] = byte(len(msg) + 4)
-	copy(buf[1:], msg)
-	binary.LittleEndian.PutUint32(buf[1+len(msg):], Crc32(msg))
+// aLongTimeAgo is a deadline in the past, used to interrupt pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// acquire locks the connection for an exchange bounded by `ctx`: its deadline
+// is applied to the connection and its cancellation interrupts pending I/O.
+// `release` must be called with the exchange's error once done; it unlocks
+// the connection and reports `ctx`'s error if it interrupted the exchange. An
+// interrupted exchange leaves the Merlin halfway through a reply or a file:
+// the connection is then closed and broken for good.
+func (c *Conn) acquire(ctx context.Context) (release func(err error) error, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	c.log.Debug("send", "buf", hex.EncodeToString(buf))
+	select {
+	case c.sem <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 
-	//c.conn.SetDeadline(time.Now().Add(10 * time.Second))
-	if sz, err := c.conn.Write(buf); err != nil {
-		return fmt.Errorf("unable to write: %w", err)
-	} else if sz != len(buf) {
-		return fmt.Errorf("unable to write %dB", len(buf))
+	if err := c.brokenErr(); err != nil {
+		<-c.sem
+		return nil, err
 	}
 
-	return nil
+	// the deadline is also enforced by the interruption below: a failure is
+	// not fatal
+	if d, ok := c.conn.(deadliner); ok {
+		deadline, _ := ctx.Deadline()
+		_ = d.SetDeadline(deadline)
+	}
+
+	var closed bool
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(interrupted)
+		closed = c.interrupt()
+	})
+
+	return func(err error) error {
+		if !stop() {
+			// wait for the interruption to be over, so it cannot leak on the
+			// next exchange
+			<-interrupted
+		}
+		defer func() { <-c.sem }()
+
+		var ctxErr error
+		if err != nil {
+			ctxErr = interruption(ctx, err)
+		}
+
+		if closed || ctxErr != nil || errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, ErrConnBroken) {
+			c.breakConn(err)
+		}
+
+		if ctxErr != nil && !errors.Is(err, ctxErr) {
+			return fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		return err
+	}, nil
 }
 
-func (c *Conn) readMsg() ([]byte, error) {
-	// read length of message
-	hdr := make([]byte, 1)
-	sz, err := c.conn.Read(hdr)
-	if err != nil || sz != 1 {
-		return nil, fmt.Errorf("unable to read length header: %w", err)
+// interruption returns the error of `ctx` if it interrupted the exchange that
+// failed with `err`. The deadline of the transport may expire just before the
+// one of `ctx`.
+func interruption(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
 	}
 
-	// read message + crc
-	payloadLen := int(hdr[0])
-	payload := make([]byte, payloadLen)
-	_, err = io.ReadAtLeast(c.conn, payload, payloadLen)
-	if err != nil {
-		return nil, fmt.Errorf("unable to read payload of %dB: %w", payloadLen, err)
+	if deadline, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
 	}
-	c.log.Debug("recv", "buf", hex.EncodeToString(payload))
-	msg := payload[:payloadLen-4]
-	gotDigest := binary.LittleEndian.Uint32(payload[payloadLen-4:])
+	return nil
+}
+
+// breakConn closes the transport, so every following exchange fails with
+// ErrConnBroken because of `cause`.
+func (c *Conn) breakConn(cause error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// check crc
-	if expectedDigest := Crc32(msg); expectedDigest != gotDigest {
-		return nil, fmt.Errorf("wrong crc32: expected %.8x, got %.8x", expectedDigest, gotDigest)
+	if c.broken != nil {
+		return
 	}
 
-	return msg, nil
+	if cause == nil {
+		cause = errors.New("transport closed by an interruption")
+	}
+	c.log.Debug("connection broken", "err", cause)
+	c.broken = fmt.Errorf("%w since: %v", ErrConnBroken, cause)
+	c.conn.Close()
 }
 
-func (c *Conn) call(inp []byte) ([]byte, error) {
+func (c *Conn) brokenErr() error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	return c.broken
+}
+
+func (c *Conn) Close() error {
+	if c.brokenErr() != nil {
+		// already closed
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+// interrupt aborts the pending I/O: by moving the deadline to the past if the
+// transport supports it, by closing it otherwise. It returns whether the
+// transport was closed.
+func (c *Conn) interrupt() bool {
+	if d, ok := c.conn.(deadliner); ok && d.SetDeadline(aLongTimeAgo) == nil {
+		return false
+	}
+
+	c.log.Debug("closing transport to interrupt exchange")
+	c.conn.Close()
+	return true
+}
+
+func (c *Conn) writedMsg(msg []byte) error {
+	c.log.Debug("send", "msg", hex.EncodeToString(msg))
+	return c.enc.Encode(msg)
+}
+
+func (c *Conn) readMsg() ([]byte, error) {
+	msg, err := c.dec.Decode()
+	if errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("unable to read message: %w", io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return nil, err
+	}
+
+	c.log.Debug("recv", "msg", hex.EncodeToString(msg))
+	return msg, nil
+}
+
+// readResponse reads the response to `cmd`. A response to another command
+// means the connection is out of sync, e.g. reading the reply to an earlier
+// exchange.
+func (c *Conn) readResponse(cmd Command) ([]byte, error) {
+	out, err := c.readMsg()
+	if err != nil {
+		return nil, err
+	} else if out[0] != cmd {
+		return nil, fmt.Errorf("%w: got a response to command 0x%.2x for command 0x%.2x", ErrConnBroken, out[0], cmd)
+	}
+
+	return out, nil
+}
+
+func (c *Conn) call(ctx context.Context, inp []byte) ([]byte, error) {
+	return c.exchange(ctx, inp, false)
+}
+
+// callSlow is call for a command the Merlin may take long to answer, such as
+// hashing a large file: the timeout of WithIOTimeout does not apply, only
+// `ctx` bounds the exchange.
+func (c *Conn) callSlow(ctx context.Context, inp []byte) ([]byte, error) {
+	return c.exchange(ctx, inp, true)
+}
+
+func (c *Conn) exchange(ctx context.Context, inp []byte, slow bool) (out []byte, err error) {
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = release(err) }()
+
+	if slow && c.ioTimeout != nil {
+		defer c.ioTimeout.pause()()
+	}
+
 	if err := c.writedMsg(inp); err != nil {
 		return nil, err
 	}
 
-	return c.readMsg()
+	return c.readResponse(inp[0])
 }
 
 func (c *Conn) Ping() error {
-	_, err := c.call([]byte{CommandPing})
+	return c.PingContext(context.Background())
+}
+
+func (c *Conn) PingContext(ctx context.Context) error {
+	_, err := c.call(ctx, []byte{CommandPing})
 	return err
 }
 
 func (c *Conn) GetSDSize() (uint32, error) {
-	out, err := c.call([]byte{CommandGetSDSize})
+	return c.GetSDSizeContext(context.Background())
+}
+
+func (c *Conn) GetSDSizeContext(ctx context.Context) (uint32, error) {
+	out, err := c.call(ctx, []byte{CommandGetSDSize})
 	if err != nil {
 		return 0, err
+	} else if err := checkResponse(CommandGetSDSize, out, 5); err != nil {
+		return 0, err
 	}
 
 	return binary.LittleEndian.Uint32(out[1:5]), nil
 }
 
 func (c *Conn) EndSynchronization() error {
-	_, err := c.call([]byte{CommandEndSynchronization})
+	return c.EndSynchronizationContext(context.Background())
+}
+
+func (c *Conn) EndSynchronizationContext(ctx context.Context) error {
+	_, err := c.call(ctx, []byte{CommandEndSynchronization})
 	return err
 }
 
 func (c *Conn) GetNumberOfFiles() (uint16, error) {
-	out, err := c.call([]byte{CommandGetNumberOfFiles})
+	return c.GetNumberOfFilesContext(context.Background())
+}
+
+func (c *Conn) GetNumberOfFilesContext(ctx context.Context) (uint16, error) {
+	out, err := c.call(ctx, []byte{CommandGetNumberOfFiles})
 	if err != nil {
 		return 0, err
+	} else if err := checkResponse(CommandGetNumberOfFiles, out, 3); err != nil {
+		return 0, err
 	}
 
 	return binary.LittleEndian.Uint16(out[1:3]), nil
@@ -139,29 +336,32 @@ type FileInformation struct {
 }
 
 func (c *Conn) GetFileInformation(idx uint16, computeSha256 bool) (*FileInformation, error) {
+	return c.GetFileInformationContext(context.Background(), idx, computeSha256)
+}
+
+func (c *Conn) GetFileInformationContext(ctx context.Context, idx uint16, computeSha256 bool) (*FileInformation, error) {
 	inp := make([]byte, 1+2+1)
 	inp[0] = CommandGetFileInformation
 	binary.LittleEndian.PutUint16(inp[1:], idx)
+	call := c.call
 	if computeSha256 {
 		inp[3] = 1
+		call = c.callSlow
 	}
 
-	out, err := c.call(inp)
+	out, err := call(ctx, inp)
 	if err != nil {
 		return nil, err
 	}
 
-	switch out[1] {
-	case 0x00:
-		// ok
-	case 0x02:
-		return nil, fmt.Errorf("bad file index")
-	case 0x03:
-		return nil, os.ErrExist
-	case 0x04:
-		return nil, fmt.Errorf("unable to open file")
-	default:
-		panic(fmt.Sprintf("unexpected `CommandGetFileInformation` status: %d", out[1]))
+	if err := checkResponse(CommandGetFileInformation, out, 2); err != nil {
+		return nil, err
+	} else if out[1] != StatusOk {
+		return nil, &StatusError{CommandGetFileInformation, out[1]}
+	} else if err := checkResponse(CommandGetFileInformation, out, 3); err != nil {
+		return nil, err
+	} else if err := checkResponse(CommandGetFileInformation, out, 3+int(out[2])+4+sha256.Size); err != nil {
+		return nil, err
 	}
 
 	pathLen := int(out[2])
@@ -176,45 +376,185 @@ func (c *Conn) GetFileInformation(idx uint16, computeSha256 bool) (*FileInformat
 	}, nil
 }
 
+func (c *Conn) LookupFileInformation(path string, computeSha256 bool) (*FileInformation, error) {
+	return c.LookupFileInformationContext(context.Background(), path, computeSha256)
+}
+
+// LookupFileInformationContext searches the file at `path` among the files of
+// the Merlin. It returns an error wrapping `os.ErrNotExist` if there is none.
+func (c *Conn) LookupFileInformationContext(ctx context.Context, path string, computeSha256 bool) (*FileInformation, error) {
+	idx, fi, err := c.lookupFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	if computeSha256 {
+		return c.GetFileInformationContext(ctx, idx, true)
+	}
+	return fi, nil
+}
+
+// lookupFile returns the index and the information, without SHA256, of the
+// file at `path`.
+func (c *Conn) lookupFile(ctx context.Context, path string) (uint16, *FileInformation, error) {
+	fileCount, err := c.GetNumberOfFilesContext(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for idx := range fileCount {
+		fi, err := c.GetFileInformationContext(ctx, idx, false)
+		if err != nil {
+			return 0, nil, err
+		} else if fi.Path == path {
+			return idx, fi, nil
+		}
+	}
+
+	return 0, nil, fmt.Errorf("file '%s': %w", path, os.ErrNotExist)
+}
+
 func (c *Conn) GetFile(path string, w io.Writer) error {
+	return c.GetFileContext(context.Background(), path, w)
+}
+
+func (c *Conn) GetFileContext(ctx context.Context, path string, w io.Writer) error {
+	r, _, err := c.OpenFileContext(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		return errors.Join(fmt.Errorf("unable to read '%s': %w", path, err), r.Close())
+	}
+
+	return r.Close()
+}
+
+func (c *Conn) OpenFile(path string) (io.ReadCloser, *FileInformation, error) {
+	return c.OpenFileContext(context.Background(), path)
+}
+
+// OpenFileContext streams the file at `path`. The connection is held until
+// the returned reader is closed; closing it before the end of the file
+// discards the rest of it. `ctx` bounds the whole stream. The returned
+// information has no SHA256.
+func (c *Conn) OpenFileContext(ctx context.Context, path string) (_ io.ReadCloser, _ *FileInformation, err error) {
 	pathRaw := []byte(path)
 	inp := make([]byte, 1+len(pathRaw))
 	inp[0] = CommandGetFile
 	copy(inp[1:], pathRaw)
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if err != nil {
+			err = release(err)
+		}
+	}()
 
 	if err := c.writedMsg(inp); err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	out, err := c.readMsg()
+	out, err := c.readResponse(CommandGetFile)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if status := out[1]; status != 0x00 {
-		return fmt.Errorf("unable to get file '%s'", path)
+	if err := checkResponse(CommandGetFile, out, 2); err != nil {
+		return nil, nil, err
+	} else if out[1] != StatusOk {
+		return nil, nil, fmt.Errorf("unable to get file '%s': %w", path, &StatusError{CommandGetFile, out[1]})
+	} else if err := checkResponse(CommandGetFile, out, 3); err != nil {
+		return nil, nil, err
+	} else if err := checkResponse(CommandGetFile, out, 3+int(out[2])+4); err != nil {
+		return nil, nil, err
 	}
 
 	filePathLen := int(out[2])
-	//retFilePath := out[3 : 3+pathLen]
-	fileSize := binary.LittleEndian.Uint32(out[3+filePathLen : 3+filePathLen+4])
-	connFileReader := io.LimitReader(c.conn, int64(fileSize))
+	fi := &FileInformation{
+		Path: string(out[3 : 3+filePathLen]),
+		Size: binary.LittleEndian.Uint32(out[3+filePathLen : 3+filePathLen+4]),
+	}
 
-	bar := progressbar.DefaultBytes(int64(fileSize), "reading "+path)
-	defer bar.Close()
-	barReader := progressbar.NewReader(connFileReader, bar)
+	c.progress.Start(TransferDownload, path, int64(fi.Size))
+	return &fileReader{
+		c:         c,
+		ctx:       ctx,
+		path:      path,
+		size:      int64(fi.Size),
+		remaining: int64(fi.Size),
+		release:   release,
+	}, fi, nil
+}
+
+type fileReader struct {
+	c         *Conn
+	ctx       context.Context
+	path      string
+	size      int64
+	remaining int64
+	release   func(err error) error
+	err       error
+	closed    bool
+}
+
+func (r *fileReader) Read(b []byte) (int, error) {
+	if r.closed {
+		return 0, os.ErrClosed
+	} else if r.err != nil {
+		return 0, r.err
+	} else if r.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	if int64(len(b)) > r.remaining {
+		b = b[:r.remaining]
+	}
+
+	n, err := r.c.conn.Read(b)
+	r.remaining -= int64(n)
+	r.c.progress.Advance(int64(n))
+
+	if errors.Is(err, io.EOF) && r.remaining > 0 {
+		err = fmt.Errorf("expected %dB, got %dB for '%s': %w", r.size, r.size-r.remaining, r.path, io.ErrUnexpectedEOF)
+	} else if errors.Is(err, io.EOF) {
+		err = nil
+	}
 
-	gotFileSize, err := io.Copy(w, &barReader)
 	if err != nil {
-		return fmt.Errorf("unable to read '%s': %w", path, err)
-	} else if gotFileSize != int64(fileSize) {
-		return fmt.Errorf("expected %dB, got %dB for '%s'", fileSize, gotFileSize, path)
+		if ctxErr := interruption(r.ctx, err); ctxErr != nil {
+			err = fmt.Errorf("%w: %w", ctxErr, err)
+		}
 	}
+	r.err = err
 
-	return nil
+	return n, err
+}
+
+func (r *fileReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	defer r.c.progress.Finish()
+
+	err := r.err
+	if err == nil && r.remaining > 0 {
+		// discard the rest of the file, so the next exchange starts on a frame
+		r.c.log.Debug("discarding rest of file", "path", r.path, "size", r.remaining)
+		_, err = io.CopyN(io.Discard, r.c.conn, r.remaining)
+	}
+
+	err = r.release(err)
+	if r.err != nil {
+		// already returned by Read
+		return nil
+	}
+	return err
 }
 
 func (c *Conn) UploadFileReader(
@@ -223,8 +563,18 @@ func (c *Conn) UploadFileReader(
 	size uint32,
 	checksum []byte,
 ) error {
+	return c.UploadFileReaderContext(context.Background(), fileName, reader, size, checksum)
+}
+
+func (c *Conn) UploadFileReaderContext(
+	ctx context.Context,
+	fileName string,
+	reader io.Reader,
+	size uint32,
+	checksum []byte,
+) (err error) {
 	if len(checksum) != sha256.Size {
-		panic("checksum should be a SHA256")
+		return fmt.Errorf("checksum should be a SHA256")
 	}
 
 	// compute sha256
@@ -235,55 +585,51 @@ func (c *Conn) UploadFileReader(
 	binary.LittleEndian.PutUint32(inp[2+len(fileName):2+len(fileName)+4], size)
 	copy(inp[2+len(fileName)+4:], checksum[:])
 
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { err = release(err) }()
 
 	if err := c.writedMsg(inp); err != nil {
 		return err
 	}
 
-	out, err := c.readMsg()
+	out, err := c.readResponse(CommandUploadFile)
 	if err != nil {
 		return err
 	}
 
-	switch out[1] {
-	case 0x00:
-		// ok
-	case 0x02:
-		return fmt.Errorf("not enough space")
-	case 0x03:
-		return fmt.Errorf("filename too large")
-	case 0x05:
-		panic("bad command length")
-	case 0x07:
-		return fmt.Errorf("fail open upload file")
-	default:
-		panic(fmt.Sprintf("unexpected `CommandUploadFile` status: %d", out[1]))
+	if err := checkResponse(CommandUploadFile, out, 2); err != nil {
+		return err
+	} else if out[1] != StatusOk {
+		return &StatusError{CommandUploadFile, out[1]}
 	}
 
-	bar := progressbar.DefaultBytes(int64(size), "writing "+fileName)
-	defer bar.Close()
-	barReader := progressbar.NewReader(reader, bar)
+	c.progress.Start(TransferUpload, fileName, int64(size))
+	defer c.progress.Finish()
+
+	// past `size`, the bytes would be read as the next command
+	if _, err := io.CopyN(c.conn, &progressReader{sourceReader{reader}, c.progress}, int64(size)); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = &sourceError{fmt.Errorf("shorter than %dB: %w", size, io.ErrShortWrite)}
+		}
 
-	if sz, err := io.Copy(c.conn, &barReader); err != nil {
+		// the Merlin is left waiting for the rest of the file
+		c.breakConn(err)
 		return fmt.Errorf("unable to write file '%s': %w", fileName, err)
-	} else if sz < int64(size) {
-		return io.ErrShortWrite
 	}
 
-	out2, err := c.readMsg()
+	out2, err := c.readResponse(CommandUploadFile)
 	if err != nil {
+		c.breakConn(err)
 		return err
 	}
 
-	switch out2[1] {
-	case 0x01:
-		// sha valid
-	case 0x04:
-		return fmt.Errorf("sha invalid")
-	default:
-		panic(fmt.Sprintf("unexpected `CommandUploadFile` end status: %d", out2[1]))
+	if err := checkResponse(CommandUploadFile, out2, 2); err != nil {
+		return err
+	} else if out2[1] != StatusUploadShaValid {
+		return &StatusError{CommandUploadFile, out2[1]}
 	}
 
 	return nil
@@ -292,6 +638,14 @@ func (c *Conn) UploadFileReader(
 func (c *Conn) UploadBytes(
 	fileName string,
 	raw []byte,
+) error {
+	return c.UploadBytesContext(context.Background(), fileName, raw)
+}
+
+func (c *Conn) UploadBytesContext(
+	ctx context.Context,
+	fileName string,
+	raw []byte,
 ) error {
 	if len(raw) >= math.MaxUint32 {
 		return fmt.Errorf("file too large")
@@ -299,38 +653,64 @@ func (c *Conn) UploadBytes(
 
 	checksum := sha256.Sum256(raw)
 
-	return c.UploadFileReader(fileName, bytes.NewReader(raw), uint32(len(raw)), checksum[:])
+	return c.UploadFileReaderContext(ctx, fileName, bytes.NewReader(raw), uint32(len(raw)), checksum[:])
 }
 
 func (c *Conn) UploadReadSeeker(
 	fileName string,
 	fh io.ReadSeeker,
 ) error {
-	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+	return c.UploadReadSeekerContext(context.Background(), fileName, fh)
+}
+
+func (c *Conn) UploadReadSeekerContext(
+	ctx context.Context,
+	fileName string,
+	fh io.ReadSeeker,
+) error {
+	size, checksum, err := hashReadSeeker(fh)
+	if err != nil {
 		return err
 	}
 
+	return c.UploadFileReaderContext(ctx, fileName, fh, size, checksum)
+}
+
+// hashReadSeeker returns the size and SHA256 of `fh`, and rewinds it.
+func hashReadSeeker(fh io.ReadSeeker) (uint32, []byte, error) {
+	if _, err := fh.Seek(0, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+
 	// compute sha256
 	hasher := sha256.New()
 	size, err := io.Copy(hasher, fh)
 	if err != nil {
-		return err
+		return 0, nil, err
 	}
 
 	if size >= math.MaxUint32 {
-		return fmt.Errorf("file too large")
+		return 0, nil, fmt.Errorf("file too large")
 	}
 
 	if _, err := fh.Seek(0, io.SeekStart); err != nil {
-		return err
+		return 0, nil, err
 	}
 
-	return c.UploadFileReader(fileName, fh, uint32(size), hasher.Sum(nil))
+	return uint32(size), hasher.Sum(nil), nil
 }
 
 func (c *Conn) UploadLocaFile(
 	fileName string,
 	localFilePath string,
+) error {
+	return c.UploadLocaFileContext(context.Background(), fileName, localFilePath)
+}
+
+func (c *Conn) UploadLocaFileContext(
+	ctx context.Context,
+	fileName string,
+	localFilePath string,
 ) error {
 	fh, err := os.Open(localFilePath)
 	if err != nil {
@@ -338,55 +718,26 @@ func (c *Conn) UploadLocaFile(
 	}
 	defer fh.Close()
 
-	return c.UploadReadSeeker(fileName, fh)
+	return c.UploadReadSeekerContext(ctx, fileName, fh)
 }
 
 func (c *Conn) UpdatePlaylist(path string) error {
+	return c.UpdatePlaylistContext(context.Background(), path)
+}
+
+func (c *Conn) UpdatePlaylistContext(ctx context.Context, path string) error {
 	inp := make([]byte, 1+len(path))
 	inp[0] = CommandUpdatePlaylist
 	copy(inp[1:], []byte(path))
-	out, err := c.call(inp)
+	out, err := c.call(ctx, inp)
 	if err != nil {
 		return err
 	}
 
-	switch out[1] {
-	case 0x00:
-		// ok?
-	case 0x01:
-		return fmt.Errorf("invalid minimum length of filename")
-	case 0x04:
-		return fmt.Errorf("failed to minifier the JSON file")
-	case 0x05:
-		return fmt.Errorf("failed open JSON file")
-	case 0x06:
-		return fmt.Errorf("failed to open playlist binary file")
-	case 0x07:
-		return fmt.Errorf("JSON root element is not an array")
-	case 0x08:
-		return fmt.Errorf("min root category size is invalid")
-	case 0x0f:
-		return fmt.Errorf("failed to rename binary tmp file")
-	case 0x10:
-		return fmt.Errorf("invalid type found in binary file")
-	case 0x11:
-		return fmt.Errorf("category JPEG not found")
-	case 0x12:
-		return fmt.Errorf("music mp32 not found")
-	case 0x13:
-		return fmt.Errorf("favorite not found")
-	case 0x14:
-		return fmt.Errorf("too many favorite")
-	case 0x15:
-		return fmt.Errorf("failed to create favorite file")
-	case 0x16:
-		return fmt.Errorf("failed to read lst fav file")
-	case 0x17:
-		return fmt.Errorf("unable to read lst fav file")
-	case 0x18:
-		return fmt.Errorf("failed to open sdcard dir")
-	default:
-		panic(fmt.Sprintf("unexpected `CommandUpdatePlaylist` end status: %d", out[1]))
+	if err := checkResponse(CommandUpdatePlaylist, out, 2); err != nil {
+		return err
+	} else if out[1] != StatusOk {
+		return &StatusError{CommandUpdatePlaylist, out[1]}
 	}
 
 	return nil
@@ -0,0 +1,268 @@
+package pinpin_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+// newSilentConn returns a connection to a Merlin which never answers.
+func newSilentConn(t *testing.T) *pinpin.Conn {
+	t.Helper()
+
+	client, server := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go io.Copy(io.Discard, server)
+
+	c := pinpin.NewConn(client)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestConnCancelPing(t *testing.T) {
+	_, c := simtest.Dial(t)
+
+	// cancelled before the exchange: the connection is untouched
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, c.PingContext(ctx), context.Canceled)
+	require.NoError(t, c.Ping())
+
+	// cancelled while waiting for the reply: the connection is broken
+	c = newSilentConn(t)
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	require.ErrorIs(t, c.PingContext(ctx), context.Canceled)
+
+	err := c.Ping()
+	require.ErrorIs(t, err, pinpin.ErrConnBroken)
+	require.NotErrorIs(t, err, context.Canceled)
+	require.NoError(t, c.Close())
+}
+
+func TestConnPingDeadline(t *testing.T) {
+	c := newSilentConn(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, c.PingContext(ctx), context.DeadlineExceeded)
+	require.ErrorIs(t, c.Ping(), pinpin.ErrConnBroken)
+}
+
+func TestConnCancelGet(t *testing.T) {
+	device, c := simtest.Dial(t)
+	require.NoError(t, device.Storage.WriteFile("big.mp3", bytes.Repeat([]byte("x"), 5<<20)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, _, err := c.OpenFileContext(ctx, "big.mp3")
+	require.NoError(t, err)
+
+	_, err = io.Copy(cancellingWriter{cancel}, r)
+	require.ErrorIs(t, err, context.Canceled)
+	require.NoError(t, r.Close())
+
+	// the rest of the file is not read as a reply
+	for _, call := range []func() error{
+		c.Ping,
+		func() error { _, err := c.GetNumberOfFiles(); return err },
+		func() error { _, err := c.GetSDSize(); return err },
+	} {
+		require.ErrorIs(t, call(), pinpin.ErrConnBroken)
+	}
+}
+
+func TestConnCancelGetFile(t *testing.T) {
+	device, c := simtest.Dial(t)
+	require.NoError(t, device.Storage.WriteFile("big.mp3", bytes.Repeat([]byte("x"), 5<<20)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := c.GetFileContext(ctx, "big.mp3", cancellingWriter{cancel})
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorContains(t, err, "unable to read 'big.mp3'")
+}
+
+func TestConnCancelUpload(t *testing.T) {
+	device, c := simtest.Dial(t)
+
+	data := bytes.Repeat([]byte("x"), 5<<20)
+	checksum := sha256.Sum256(data)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := c.UploadFileReaderContext(ctx, "big.mp3", &cancellingReader{bytes.NewReader(data), cancel}, uint32(len(data)), checksum[:])
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, c.Ping(), pinpin.ErrConnBroken)
+
+	_, err = device.Storage.Stat("big.mp3")
+	require.Error(t, err)
+}
+
+func TestConnUploadShortSource(t *testing.T) {
+	device, c := simtest.Dial(t)
+
+	// announced as 4B, the source only has 3B
+	checksum := sha256.Sum256([]byte("mp3!"))
+	err := c.UploadFileReaderContext(context.Background(), "story.mp3", bytes.NewReader([]byte("mp3")), 4, checksum[:])
+	require.ErrorIs(t, err, io.ErrShortWrite)
+	require.ErrorIs(t, c.Ping(), pinpin.ErrConnBroken)
+
+	_, err = device.Storage.Stat("story.mp3")
+	require.Error(t, err)
+}
+
+func TestConnUploadLongSource(t *testing.T) {
+	device, c := simtest.Dial(t)
+
+	// the bytes past the announced size are not sent
+	checksum := sha256.Sum256([]byte("mp3"))
+	require.NoError(t, c.UploadFileReaderContext(context.Background(), "story.mp3", bytes.NewReader([]byte("mp3 and more")), 3, checksum[:]))
+	require.NoError(t, c.Ping())
+
+	data, err := device.Storage.ReadFile("story.mp3")
+	require.NoError(t, err)
+	require.Equal(t, []byte("mp3"), data)
+}
+
+func TestConnWaitsForLock(t *testing.T) {
+	device, c := simtest.Dial(t)
+	require.NoError(t, device.Storage.WriteFile("story.mp3", []byte("mp3")))
+
+	// the open file holds the connection
+	r, _, err := c.OpenFile("story.mp3")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, c.PingContext(ctx), context.DeadlineExceeded)
+
+	// giving up on the lock does not break the connection
+	require.NoError(t, r.Close())
+	require.NoError(t, c.Ping())
+}
+
+func TestConnUnexpectedResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// the Merlin answers the reply to another command
+	go func() {
+		if _, err := pinpin.NewFrameDecoder(server).Decode(); err == nil {
+			pinpin.NewFrameEncoder(server).Encode([]byte{pinpin.CommandGetFile, pinpin.StatusOk})
+		}
+	}()
+
+	c := pinpin.NewConn(client)
+	defer c.Close()
+	require.ErrorIs(t, c.Ping(), pinpin.ErrConnBroken)
+	require.ErrorIs(t, c.Ping(), pinpin.ErrConnBroken)
+}
+
+// cancellingWriter cancels the exchange on the first write, and waits for the
+// interruption to take place.
+type cancellingWriter struct {
+	cancel context.CancelFunc
+}
+
+func (w cancellingWriter) Write(b []byte) (int, error) {
+	w.cancel()
+	time.Sleep(10 * time.Millisecond)
+	return len(b), nil
+}
+
+// cancellingReader cancels the exchange once half of `r` is read, and waits
+// for the interruption to take place.
+type cancellingReader struct {
+	r      *bytes.Reader
+	cancel context.CancelFunc
+}
+
+func (r *cancellingReader) Read(b []byte) (int, error) {
+	if r.r.Len() < int(r.r.Size()/2) {
+		r.cancel()
+		time.Sleep(10 * time.Millisecond)
+	}
+	return r.r.Read(b)
+}
+
+func TestOpenFile(t *testing.T) {
+	device, c := simtest.Dial(t)
+	data := bytes.Repeat([]byte("pinpin"), 10000)
+	require.NoError(t, device.Storage.WriteFile("story.mp3", data))
+
+	r, fi, err := c.OpenFile("story.mp3")
+	require.NoError(t, err)
+	require.Equal(t, "story.mp3", fi.Path)
+	require.Equal(t, uint32(len(data)), fi.Size)
+
+	got, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	require.NoError(t, r.Close())
+
+	_, err = r.Read(make([]byte, 1))
+	require.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestOpenFileCloseEarly(t *testing.T) {
+	device, c := simtest.Dial(t)
+	data := bytes.Repeat([]byte("pinpin"), 10000)
+	require.NoError(t, device.Storage.WriteFile("story.mp3", data))
+
+	r, _, err := c.OpenFile("story.mp3")
+	require.NoError(t, err)
+	head := make([]byte, 10)
+	_, err = io.ReadFull(r, head)
+	require.NoError(t, err)
+	require.Equal(t, data[:10], head)
+
+	// the rest of the file is discarded
+	require.NoError(t, r.Close())
+	require.NoError(t, c.Ping())
+
+	var buf bytes.Buffer
+	require.NoError(t, c.GetFile("story.mp3", &buf))
+	require.Equal(t, data, buf.Bytes())
+}
+
+func TestOpenFileShortStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// the Merlin announces 10B and sends 4B
+	go func() {
+		if _, err := pinpin.NewFrameDecoder(server).Decode(); err != nil {
+			return
+		}
+
+		out := []byte{pinpin.CommandGetFile, pinpin.StatusOk, byte(len("story.mp3"))}
+		out = append(out, "story.mp3"...)
+		out = binary.LittleEndian.AppendUint32(out, 10)
+		pinpin.NewFrameEncoder(server).Encode(out)
+		server.Write([]byte("mp3!"))
+		server.Close()
+	}()
+
+	c := pinpin.NewConn(client)
+	defer c.Close()
+
+	r, fi, err := c.OpenFile("story.mp3")
+	require.NoError(t, err)
+	require.Equal(t, uint32(10), fi.Size)
+
+	got, err := io.ReadAll(r)
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, []byte("mp3!"), got)
+	require.NoError(t, r.Close())
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gawen/pinpin/sim"
+)
+
+type statusFlags map[byte]byte
+
+func (f statusFlags) String() string {
+	var parts []string
+	for cmd, status := range f {
+		parts = append(parts, fmt.Sprintf("0x%.2x=0x%.2x", cmd, status))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (f statusFlags) Set(value string) error {
+	cmdRaw, statusRaw, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected <command>=<status>, got '%s'", value)
+	}
+
+	cmd, err := strconv.ParseUint(cmdRaw, 0, 8)
+	if err != nil {
+		return fmt.Errorf("invalid command '%s': %w", cmdRaw, err)
+	}
+
+	status, err := strconv.ParseUint(statusRaw, 0, 8)
+	if err != nil {
+		return fmt.Errorf("invalid status '%s': %w", statusRaw, err)
+	}
+
+	f[byte(cmd)] = byte(status)
+	return nil
+}
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:50000", "address to listen on")
+	dir := flag.String("dir", "", "directory backing the SD card (in memory if empty)")
+	capacity := flag.Uint("capacity", uint(sim.DefaultCapacity), "SD card capacity in bytes")
+	verbose := flag.Bool("v", false, "log every frame")
+	statuses := make(statusFlags)
+	flag.Var(statuses, "status", "force a command to answer a status, e.g. '0x06=0x14' (repeatable)")
+	flag.Parse()
+
+	if *verbose {
+		slog.SetLogLoggerLevel(slog.LevelDebug)
+	}
+
+	var storage sim.Storage = sim.NewMemoryStorage()
+	if *dir != "" {
+		dirStorage, err := sim.NewDirStorage(*dir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to open SD card directory: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		defer dirStorage.Close()
+		storage = dirStorage
+	}
+
+	device := sim.NewDevice(storage)
+	device.Capacity = uint32(*capacity)
+	for cmd, status := range statuses {
+		device.SetStatus(cmd, status)
+	}
+
+	fmt.Fprintf(os.Stderr, "🎧 simulated Merlin listening on %s\n", *listen)
+	if err := device.ListenAndServe(*listen); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to serve: %s\n", err.Error())
+		os.Exit(-1)
+	}
+}
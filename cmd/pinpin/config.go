@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gawen/pinpin"
+	"gopkg.in/yaml.v3"
+)
+
+// libraryConfigName is the file, at the root of a library, configuring how it
+// is synced.
+const libraryConfigName = "pinpin.yaml"
+
+// libraryConfig is the content of `pinpin.yaml`. The paths are relative to
+// the library root, with slashes, such as `Historias` for a folder or
+// `Historias/Gato.mp3` for a story.
+type libraryConfig struct {
+	// Address of the Merlin, unless given by -address or $PINPIN_ADDRESS.
+	Address   string           `yaml:"address"`
+	Transcode transcodeProfile `yaml:"transcode"`
+	// Sort orders the folders and their stories: newest (default), oldest
+	// or title.
+	Sort string `yaml:"sort"`
+	// Favorites are stories, while Discover may also hold folders.
+	Favorites []string `yaml:"favorites"`
+	Discover  []string `yaml:"discover"`
+	// Covers maps a folder to its JPEG image. Once read, the image paths
+	// are resolved.
+	Covers  map[string]string `yaml:"covers"`
+	Exclude []string          `yaml:"exclude"`
+}
+
+type transcodeProfile struct {
+	Bitrate    string `yaml:"bitrate"`
+	SampleRate int    `yaml:"sample_rate"`
+	Channels   int    `yaml:"channels"`
+}
+
+var defaultTranscodeProfile = transcodeProfile{
+	Bitrate:    "128k",
+	SampleRate: 44100,
+	Channels:   2,
+}
+
+const (
+	librarySortNewest = "newest"
+	librarySortOldest = "oldest"
+	librarySortTitle  = "title"
+)
+
+// coverSize is the width and height of the default covers.
+const coverSize = 128
+
+var bitrateRegexp = regexp.MustCompile(`^([0-9]+)k$`)
+
+// mp3SampleRates are the sample rates MPEG audio supports.
+var mp3SampleRates = []int{8000, 11025, 12000, 16000, 22050, 24000, 32000, 44100, 48000}
+
+// readLibraryConfig reads and validates the `pinpin.yaml` of the library at
+// `basePath`. Without one, the defaults are used.
+func readLibraryConfig(basePath string) (*libraryConfig, error) {
+	config := new(libraryConfig)
+
+	fh, err := os.Open(filepath.Join(basePath, libraryConfigName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	} else if err == nil {
+		defer fh.Close()
+
+		dec := yaml.NewDecoder(fh)
+		dec.KnownFields(true)
+		if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("unable to parse '%s': %w", libraryConfigName, err)
+		}
+	}
+
+	// the profile may only override some of the defaults
+	if config.Transcode.Bitrate == "" {
+		config.Transcode.Bitrate = defaultTranscodeProfile.Bitrate
+	}
+	if config.Transcode.SampleRate == 0 {
+		config.Transcode.SampleRate = defaultTranscodeProfile.SampleRate
+	}
+	if config.Transcode.Channels == 0 {
+		config.Transcode.Channels = defaultTranscodeProfile.Channels
+	}
+	if config.Sort == "" {
+		config.Sort = librarySortNewest
+	}
+
+	if err := config.validate(basePath); err != nil {
+		return nil, fmt.Errorf("invalid '%s': %w", libraryConfigName, err)
+	}
+	return config, nil
+}
+
+func (c *libraryConfig) validate(basePath string) error {
+	var errs []error
+
+	if c.Address != "" {
+		if _, _, err := net.SplitHostPort(c.Address); err != nil {
+			errs = append(errs, fmt.Errorf("address: %w", err))
+		}
+	}
+
+	if err := c.Transcode.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("transcode: %w", err))
+	}
+
+	switch c.Sort {
+	case librarySortNewest, librarySortOldest, librarySortTitle:
+	default:
+		errs = append(errs, fmt.Errorf("sort: unknown order '%s', expected newest, oldest or title", c.Sort))
+	}
+
+	// the paths are normalized, to be compared to the ones of the library
+	for _, paths := range [][]string{c.Favorites, c.Discover, c.Exclude} {
+		for idx, p := range paths {
+			paths[idx] = path.Clean(p)
+		}
+	}
+
+	for _, p := range c.Exclude {
+		if err := checkLibraryPath(basePath, p); err != nil {
+			errs = append(errs, fmt.Errorf("exclude: %w", err))
+		}
+	}
+	for _, p := range c.Favorites {
+		// the folders of the library are top-level, its stories below
+		kind := pinpin.PlaylistItemKindAudio
+		if !strings.Contains(p, "/") {
+			kind = pinpin.PlaylistItemKindFolder
+		}
+
+		if err := checkLibraryPath(basePath, p); err != nil {
+			errs = append(errs, fmt.Errorf("favorites: %w", err))
+		} else if err := pinpin.CheckPlaylistFavorite(kind); err != nil {
+			errs = append(errs, fmt.Errorf("favorites: '%s': %w", p, err))
+		} else if c.excluded(p) {
+			errs = append(errs, fmt.Errorf("favorites: '%s' is excluded", p))
+		}
+	}
+	for _, p := range c.Discover {
+		if err := checkLibraryPath(basePath, p); err != nil {
+			errs = append(errs, fmt.Errorf("discover: %w", err))
+		} else if c.excluded(p) {
+			errs = append(errs, fmt.Errorf("discover: '%s' is excluded", p))
+		}
+	}
+
+	// the covers are resolved from the library root
+	covers := make(map[string]string, len(c.Covers))
+	for folder, imagePath := range c.Covers {
+		folder = path.Clean(folder)
+		imagePath = filepath.FromSlash(imagePath)
+		if !filepath.IsAbs(imagePath) {
+			imagePath = filepath.Join(basePath, imagePath)
+		}
+		covers[folder] = imagePath
+
+		if strings.Contains(folder, "/") {
+			errs = append(errs, fmt.Errorf("covers: '%s' is not a top-level folder", folder))
+		} else if fi, err := os.Stat(filepath.Join(basePath, folder)); err != nil {
+			errs = append(errs, fmt.Errorf("covers: %w", err))
+		} else if !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("covers: '%s' is not a folder", folder))
+		} else if err := checkCover(imagePath); err != nil {
+			errs = append(errs, fmt.Errorf("covers: '%s': %w", folder, err))
+		}
+	}
+	c.Covers = covers
+
+	return errors.Join(errs...)
+}
+
+func (p transcodeProfile) validate() error {
+	var errs []error
+
+	if m := bitrateRegexp.FindStringSubmatch(p.Bitrate); m == nil {
+		errs = append(errs, fmt.Errorf("bitrate: invalid '%s', expected kbit/s such as '128k'", p.Bitrate))
+	} else if kbps, _ := strconv.Atoi(m[1]); kbps < 8 || kbps > 320 {
+		errs = append(errs, fmt.Errorf("bitrate: %s out of the 8k-320k range", p.Bitrate))
+	}
+
+	if !slices.Contains(mp3SampleRates, p.SampleRate) {
+		errs = append(errs, fmt.Errorf("sample_rate: unsupported %dHz, expected one of %v", p.SampleRate, mp3SampleRates))
+	}
+
+	if p.Channels != 1 && p.Channels != 2 {
+		errs = append(errs, fmt.Errorf("channels: %d, expected 1 or 2", p.Channels))
+	}
+
+	return errors.Join(errs...)
+}
+
+// ffmpegArgs are the ffmpeg arguments transcoding the first audio stream of
+// `inPath` to `outPath`.
+func (p transcodeProfile) ffmpegArgs(inPath string, outPath string) []string {
+	return []string{
+		"-i", inPath,
+		"-map", "0:a:0",
+		"-c:a", "libmp3lame",
+		"-b:a", p.Bitrate,
+		"-ar", strconv.Itoa(p.SampleRate),
+		"-ac", strconv.Itoa(p.Channels),
+		"-sample_fmt", "fltp",
+		outPath,
+	}
+}
+
+// uuidSalt is mixed into the UUID of the stories, so a story transcoded with
+// another profile is another file. It is empty for the default profile, which
+// keeps the UUIDs of the libraries synced before `pinpin.yaml`.
+func (p transcodeProfile) uuidSalt() string {
+	if p == defaultTranscodeProfile {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d/%d", p.Bitrate, p.SampleRate, p.Channels)
+}
+
+func (c *libraryConfig) excluded(p string) bool {
+	for _, excluded := range c.Exclude {
+		if p == excluded || strings.HasPrefix(p, excluded+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *libraryConfig) favorite(p string) bool {
+	return slices.Contains(c.Favorites, p)
+}
+
+func (c *libraryConfig) discover(p string) bool {
+	return slices.Contains(c.Discover, p)
+}
+
+// checkLibraryPath checks `p` is a folder or a story of the library.
+func checkLibraryPath(basePath string, p string) error {
+	if p == "." || !filepath.IsLocal(filepath.FromSlash(p)) {
+		return fmt.Errorf("'%s' is outside of the library", p)
+	} else if strings.Count(p, "/") > 1 {
+		return fmt.Errorf("'%s' is deeper than a story", p)
+	}
+
+	if _, err := os.Stat(filepath.Join(basePath, filepath.FromSlash(p))); err != nil {
+		return err
+	}
+	return nil
+}
+
+// checkCover checks the image at `path` is a JPEG. Another size than the
+// default covers' is only reported, as the Merlin may scale it.
+func checkCover(path string) error {
+	fh, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	cfg, err := jpeg.DecodeConfig(fh)
+	if err != nil {
+		return fmt.Errorf("'%s' is not a JPEG: %w", path, err)
+	}
+
+	if cfg.Width != coverSize || cfg.Height != coverSize {
+		fmt.Fprintf(os.Stderr, "⚠️ cover '%s' is %dx%d, the Merlin's are %dx%d\n", path, cfg.Width, cfg.Height, coverSize, coverSize)
+	}
+	return nil
+}
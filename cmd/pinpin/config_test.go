@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gawen/pinpin"
+	"github.com/stretchr/testify/require"
+)
+
+// writeLibraryTest writes the files of a library, mapped by their slashed
+// path, to a new folder.
+func writeLibraryTest(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+
+	basePath := t.TempDir()
+	for p, data := range files {
+		p = filepath.Join(basePath, filepath.FromSlash(p))
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, data, 0o644))
+	}
+	return basePath
+}
+
+func TestReadLibraryConfig(t *testing.T) {
+	basePath := writeLibraryTest(t, map[string][]byte{
+		"Historias/Gato.mp3":  []byte("gato"),
+		"Historias/cover.jpg": pickAssetJpegRaw([]byte{0}),
+		"Historias/cover.txt": []byte("not a cover"),
+		"Cuentos/Perro.mp3":   []byte("perro"),
+		"notes.txt":           []byte("notes"),
+	})
+
+	for _, tc := range []struct {
+		name   string
+		config string
+		check  func(t *testing.T, config *libraryConfig)
+		err    string
+		errIs  error
+	}{
+		{
+			name:   "empty",
+			config: "",
+			check: func(t *testing.T, config *libraryConfig) {
+				require.Equal(t, defaultTranscodeProfile, config.Transcode)
+				require.Equal(t, librarySortNewest, config.Sort)
+			},
+		},
+		{
+			name:   "unknown field",
+			config: "favourites: [Historias/Gato.mp3]\n",
+			err:    "field favourites not found",
+		},
+		{
+			name:   "invalid yaml",
+			config: "favorites: [Historias\n",
+			err:    "unable to parse 'pinpin.yaml'",
+		},
+		{
+			name:   "address",
+			config: "address: 192.168.4.1:8080\n",
+			check: func(t *testing.T, config *libraryConfig) {
+				require.Equal(t, "192.168.4.1:8080", config.Address)
+			},
+		},
+		{
+			name:   "address without port",
+			config: "address: 192.168.4.1\n",
+			err:    "address: address 192.168.4.1: missing port",
+		},
+		{
+			name:   "transcode",
+			config: "transcode: {channels: 1}\n",
+			check: func(t *testing.T, config *libraryConfig) {
+				require.Equal(t, transcodeProfile{Bitrate: "128k", SampleRate: 44100, Channels: 1}, config.Transcode)
+			},
+		},
+		{
+			name:   "transcode bitrate",
+			config: "transcode: {bitrate: fast}\n",
+			err:    "transcode: bitrate: invalid 'fast'",
+		},
+		{
+			name:   "transcode bitrate range",
+			config: "transcode: {bitrate: 500k}\n",
+			err:    "transcode: bitrate: 500k out of the 8k-320k range",
+		},
+		{
+			name:   "transcode sample rate",
+			config: "transcode: {sample_rate: 1000}\n",
+			err:    "transcode: sample_rate: unsupported 1000Hz",
+		},
+		{
+			name:   "transcode channels",
+			config: "transcode: {channels: 3}\n",
+			err:    "transcode: channels: 3, expected 1 or 2",
+		},
+		{
+			name:   "sort oldest",
+			config: "sort: oldest\n",
+			check: func(t *testing.T, config *libraryConfig) {
+				require.Equal(t, librarySortOldest, config.Sort)
+			},
+		},
+		{
+			name:   "sort title",
+			config: "sort: title\n",
+			check: func(t *testing.T, config *libraryConfig) {
+				require.Equal(t, librarySortTitle, config.Sort)
+			},
+		},
+		{
+			name:   "sort unknown",
+			config: "sort: random\n",
+			err:    "sort: unknown order 'random'",
+		},
+		{
+			name:   "exclude",
+			config: "exclude: [Cuentos, ./Historias//Gato.mp3]\n",
+			check: func(t *testing.T, config *libraryConfig) {
+				require.True(t, config.excluded("Cuentos"))
+				require.True(t, config.excluded("Cuentos/Perro.mp3"))
+				require.True(t, config.excluded("Historias/Gato.mp3"))
+				require.False(t, config.excluded("Historias"))
+				require.False(t, config.excluded("Cuentos2"))
+			},
+		},
+		{
+			name:   "exclude outside",
+			config: "exclude: [../Cuentos]\n",
+			err:    "exclude: '../Cuentos' is outside of the library",
+		},
+		{
+			name:   "exclude root",
+			config: "exclude: [.]\n",
+			err:    "exclude: '.' is outside of the library",
+		},
+		{
+			name:   "exclude too deep",
+			config: "exclude: [Historias/Gato.mp3/x]\n",
+			err:    "exclude: 'Historias/Gato.mp3/x' is deeper than a story",
+		},
+		{
+			name:   "exclude missing",
+			config: "exclude: [Fabulas]\n",
+			errIs:  os.ErrNotExist,
+		},
+		{
+			name:   "favorites and discover",
+			config: "favorites: [Historias/Gato.mp3]\ndiscover: [Historias, Cuentos/Perro.mp3]\n",
+			check: func(t *testing.T, config *libraryConfig) {
+				require.True(t, config.favorite("Historias/Gato.mp3"))
+				require.False(t, config.favorite("Cuentos/Perro.mp3"))
+				require.True(t, config.discover("Historias"))
+				require.True(t, config.discover("Cuentos/Perro.mp3"))
+				require.False(t, config.discover("Cuentos"))
+			},
+		},
+		{
+			name:   "favorite folder",
+			config: "favorites: [Historias]\n",
+			err:    "favorites: 'Historias'",
+			errIs:  pinpin.ErrPlaylistNotTrack,
+		},
+		{
+			name:   "favorite excluded",
+			config: "favorites: [Historias/Gato.mp3]\nexclude: [Historias]\n",
+			err:    "favorites: 'Historias/Gato.mp3' is excluded",
+		},
+		{
+			name:   "favorite missing",
+			config: "favorites: [Historias/Perro.mp3]\n",
+			errIs:  os.ErrNotExist,
+		},
+		{
+			name:   "discover excluded",
+			config: "discover: [Cuentos]\nexclude: [Cuentos]\n",
+			err:    "discover: 'Cuentos' is excluded",
+		},
+		{
+			name:   "discover outside",
+			config: "discover: [/Cuentos]\n",
+			err:    "discover: '/Cuentos' is outside of the library",
+		},
+		{
+			name:   "covers",
+			config: "covers: {Historias: Historias/cover.jpg}\n",
+			check: func(t *testing.T, config *libraryConfig) {
+				require.Equal(t, map[string]string{"Historias": filepath.Join(basePath, "Historias", "cover.jpg")}, config.Covers)
+			},
+		},
+		{
+			name:   "cover of a story",
+			config: "covers: {Historias/Gato.mp3: Historias/cover.jpg}\n",
+			err:    "covers: 'Historias/Gato.mp3' is not a top-level folder",
+		},
+		{
+			name:   "cover of a file",
+			config: "covers: {notes.txt: Historias/cover.jpg}\n",
+			err:    "covers: 'notes.txt' is not a folder",
+		},
+		{
+			name:   "cover of a missing folder",
+			config: "covers: {Fabulas: Historias/cover.jpg}\n",
+			errIs:  os.ErrNotExist,
+		},
+		{
+			name:   "cover not a JPEG",
+			config: "covers: {Historias: Historias/cover.txt}\n",
+			err:    "covers: 'Historias': '" + filepath.Join(basePath, "Historias", "cover.txt") + "' is not a JPEG",
+		},
+		{
+			name:   "cover missing",
+			config: "covers: {Historias: Historias/missing.jpg}\n",
+			errIs:  os.ErrNotExist,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(filepath.Join(basePath, libraryConfigName), []byte(tc.config), 0o644))
+
+			config, err := readLibraryConfig(basePath)
+			if tc.err == "" && tc.errIs == nil {
+				require.NoError(t, err)
+				tc.check(t, config)
+				return
+			}
+
+			if tc.err != "" {
+				require.ErrorContains(t, err, tc.err)
+			}
+			if tc.errIs != nil {
+				require.ErrorIs(t, err, tc.errIs)
+			}
+		})
+	}
+
+	// without `pinpin.yaml`, the defaults are used
+	require.NoError(t, os.Remove(filepath.Join(basePath, libraryConfigName)))
+	config, err := readLibraryConfig(basePath)
+	require.NoError(t, err)
+	require.Equal(t, &libraryConfig{Transcode: defaultTranscodeProfile, Sort: librarySortNewest, Covers: map[string]string{}}, config)
+}
+
+func TestCheckCoverSize(t *testing.T) {
+	var raw bytes.Buffer
+	require.NoError(t, jpeg.Encode(&raw, image.NewGray(image.Rect(0, 0, 64, 32)), nil))
+	coverPath := filepath.Join(t.TempDir(), "cover.jpg")
+	require.NoError(t, os.WriteFile(coverPath, raw.Bytes(), 0o644))
+
+	// another size is only reported
+	stderr := captureStderrTest(t, func() {
+		require.NoError(t, checkCover(coverPath))
+	})
+	require.Contains(t, stderr, "is 64x32, the Merlin's are 128x128")
+}
+
+// captureStderrTest returns what `f` writes to the standard error.
+func captureStderrTest(t *testing.T, f func()) string {
+	t.Helper()
+
+	stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	require.NoError(t, err)
+	defer stderr.Close()
+
+	oldStderr := os.Stderr
+	os.Stderr = stderr
+	defer func() { os.Stderr = oldStderr }()
+	f()
+
+	_, err = stderr.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	raw, err := io.ReadAll(stderr)
+	require.NoError(t, err)
+	return string(raw)
+}
+
+func TestTranscodeProfileUUIDSalt(t *testing.T) {
+	// the UUIDs of the stories already on a Merlin depend on it
+	require.Equal(t, "", defaultTranscodeProfile.uuidSalt())
+	require.Equal(t, "96k/22050/1", transcodeProfile{Bitrate: "96k", SampleRate: 22050, Channels: 1}.uuidSalt())
+
+	storyPath := filepath.Join(t.TempDir(), "Gato.mp3")
+	require.NoError(t, os.WriteFile(storyPath, []byte("gato"), 0o644))
+	for salt, want := range map[string]string{
+		"":            "d4e8973e-04e6-57a4-c616-67481bc98d64",
+		"96k/22050/1": "4114ab7c-a92f-4a36-846a-b0ee0fbedd43",
+	} {
+		u, err := filePinpinUUID(storyPath, salt)
+		require.NoError(t, err)
+		require.True(t, isPinpinUUID(u))
+		require.Equal(t, want, u.String(), salt)
+	}
+}
+
+func TestSortLibraryNodes(t *testing.T) {
+	newNodes := func() []*pinpin.PlaylistTreeNode {
+		return []*pinpin.PlaylistTreeNode{
+			{Title: "b", AddTimeUnix: 2},
+			{Title: "c", AddTimeUnix: 1},
+			{Title: "a", AddTimeUnix: 2},
+			{Title: "d", AddTimeUnix: 3},
+		}
+	}
+
+	for order, want := range map[string][]string{
+		librarySortNewest: {"d", "b", "a", "c"},
+		librarySortOldest: {"c", "b", "a", "d"},
+		librarySortTitle:  {"a", "b", "c", "d"},
+	} {
+		nodes := newNodes()
+		sortLibraryNodes(nodes, order)
+
+		var titles []string
+		for _, node := range nodes {
+			titles = append(titles, node.Title)
+		}
+		require.Equal(t, want, titles, order)
+	}
+}
+
+func TestReadLibrary(t *testing.T) {
+	cover := pickAssetJpegRaw([]byte{1})
+	basePath := writeLibraryTest(t, map[string][]byte{
+		libraryConfigName: []byte(
+			"favorites: [Historias/Gato.mp3]\n" +
+				"discover: [Historias]\n" +
+				"covers: {Historias: Historias/cover.jpg}\n" +
+				"exclude: [Cuentos, Historias/Raton.mp3]\n" +
+				"transcode: {channels: 1}\n"),
+		"Historias/Gato.mp3":  []byte("gato"),
+		"Historias/Raton.mp3": []byte("raton"),
+		"Historias/cover.jpg": cover,
+		"Cuentos/Perro.mp3":   []byte("perro"),
+	})
+	cachePath := t.TempDir()
+
+	// transcoded already, so ffmpeg is not run
+	salt := transcodeProfile{Bitrate: "128k", SampleRate: 44100, Channels: 1}.uuidSalt()
+	gatoUUID, err := filePinpinUUID(filepath.Join(basePath, "Historias", "Gato.mp3"), salt)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(cachePath, gatoUUID.String()+".mp3"), []byte("mp3"), 0o644))
+
+	var nodes []*pinpin.PlaylistTreeNode
+	stderr := captureStderrTest(t, func() {
+		nodes, _, err = readLibrary(basePath, cachePath)
+	})
+	require.NoError(t, err)
+	// the cover is not taken as an unexpected file
+	require.Empty(t, stderr)
+
+	folderUUID := titlePinpinUUID("Historias")
+	require.Equal(t, []*pinpin.PlaylistTreeNode{{
+		UUID:        folderUUID.String(),
+		Title:       "Historias",
+		AddTimeUnix: nodes[0].AddTimeUnix,
+		Discover:    1,
+		Children: []*pinpin.PlaylistTreeNode{{
+			UUID:        gatoUUID.String(),
+			Title:       "Gato",
+			AddTimeUnix: nodes[0].Children[0].AddTimeUnix,
+			Favorite:    1,
+		}},
+	}}, nodes)
+
+	image, err := os.ReadFile(filepath.Join(cachePath, folderUUID.String()+".jpg"))
+	require.NoError(t, err)
+	require.Equal(t, cover, image)
+}
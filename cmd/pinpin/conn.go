@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gawen/pinpin"
+)
+
+// connFlags are the flags of the commands talking to the Merlin. Their
+// defaults can be set with the PINPIN_* environment variables.
+type connFlags struct {
+	address   string
+	policy    pinpin.RetryPolicy
+	ioTimeout time.Duration
+	tracePath string
+}
+
+// addConnFlags adds the connection flags to `fs`. It fails if one of the
+// PINPIN_* environment variables is invalid.
+func addConnFlags(fs *flag.FlagSet) (*connFlags, error) {
+	attempts, attemptsErr := envInt("PINPIN_ATTEMPTS", pinpin.DefaultRetryPolicy.Attempts)
+	backoff, backoffErr := envDuration("PINPIN_BACKOFF", pinpin.DefaultRetryPolicy.Backoff)
+	maxBackoff, maxBackoffErr := envDuration("PINPIN_MAX_BACKOFF", pinpin.DefaultRetryPolicy.MaxBackoff)
+	dialTimeout, dialTimeoutErr := envDuration("PINPIN_DIAL_TIMEOUT", pinpin.DefaultRetryPolicy.DialTimeout)
+	ioTimeout, ioTimeoutErr := envDuration("PINPIN_IO_TIMEOUT", 30*time.Second)
+	if err := errors.Join(attemptsErr, backoffErr, maxBackoffErr, dialTimeoutErr, ioTimeoutErr); err != nil {
+		return nil, err
+	}
+
+	f := new(connFlags)
+	fs.StringVar(&f.address, "address", envString("PINPIN_ADDRESS", "192.168.4.1:50000"), "address of the Merlin ($PINPIN_ADDRESS)")
+	fs.IntVar(&f.policy.Attempts, "attempts", attempts, "number of times an operation is tried before giving up ($PINPIN_ATTEMPTS)")
+	fs.DurationVar(&f.policy.Backoff, "backoff", backoff, "wait before the second attempt, doubled after each attempt ($PINPIN_BACKOFF)")
+	fs.DurationVar(&f.policy.MaxBackoff, "max-backoff", maxBackoff, "maximum wait between attempts, 0 for none ($PINPIN_MAX_BACKOFF)")
+	fs.DurationVar(&f.policy.DialTimeout, "dial-timeout", dialTimeout, "timeout to connect to the Merlin, 0 for none ($PINPIN_DIAL_TIMEOUT)")
+	fs.DurationVar(&f.ioTimeout, "io-timeout", ioTimeout, "timeout of a read or a write with no progress, but while the Merlin hashes a file, 0 for none ($PINPIN_IO_TIMEOUT)")
+	fs.StringVar(&f.tracePath, "trace", "", "record the exchanges with the Merlin to this JSONL file")
+	return f, nil
+}
+
+func mustAddConnFlags(fs *flag.FlagSet) *connFlags {
+	f, err := addConnFlags(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+	return f
+}
+
+// setDefaultAddress connects to `address`, such as the one of the library
+// configuration, unless another one is given by -address or $PINPIN_ADDRESS.
+func (f *connFlags) setDefaultAddress(fs *flag.FlagSet, address string) {
+	if address == "" || envString("PINPIN_ADDRESS", "") != "" {
+		return
+	}
+
+	explicit := false
+	fs.Visit(func(fl *flag.Flag) {
+		explicit = explicit || fl.Name == "address"
+	})
+	if !explicit {
+		f.address = address
+	}
+}
+
+func envString(name string, def string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) (int, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid $%s: %w", name, err)
+	}
+	return i, nil
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid $%s: %w", name, err)
+	}
+	return d, nil
+}
+
+// connect opens a session to the Merlin and checks it answers. The returned
+// closer also closes the trace file.
+func (f *connFlags) connect(ctx context.Context, opts ...pinpin.Option) (*pinpin.Session, io.Closer, error) {
+	var traceFile *os.File
+	if f.tracePath != "" {
+		var err error
+		traceFile, err = os.Create(f.tracePath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to create trace file: %w", err)
+		}
+
+		opts = append(opts, pinpin.WithTraceRecorder(traceFile))
+	}
+
+	if f.ioTimeout > 0 {
+		opts = append(opts, pinpin.WithIOTimeout(f.ioTimeout))
+	}
+
+	session := pinpin.NewSession(f.address, f.policy, opts...)
+	session.OnRetry = func(attempt int, err error) {
+		fmt.Fprintf(os.Stderr, "attempt #%d failed: %s\n", attempt, err.Error())
+	}
+
+	closer := sessionCloser{session, traceFile}
+	if _, err := session.Conn(ctx); err != nil {
+		closer.Close()
+		return nil, nil, fmt.Errorf("unable to connect to the Merlin: %w", err)
+	}
+
+	return session, closer, nil
+}
+
+type sessionCloser struct {
+	session   *pinpin.Session
+	traceFile *os.File
+}
+
+func (c sessionCloser) Close() error {
+	err := c.session.Close()
+	if c.traceFile != nil {
+		c.traceFile.Close()
+	}
+	return err
+}
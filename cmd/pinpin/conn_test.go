@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		env           map[string]string
+		args          []string
+		configAddress string
+		want          connFlags
+	}{
+		{
+			name: "defaults",
+			want: connFlags{
+				address:   "192.168.4.1:50000",
+				policy:    pinpin.DefaultRetryPolicy,
+				ioTimeout: 30 * time.Second,
+			},
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				"PINPIN_ADDRESS":      "10.0.0.1:50000",
+				"PINPIN_ATTEMPTS":     "5",
+				"PINPIN_BACKOFF":      "1s",
+				"PINPIN_MAX_BACKOFF":  "4s",
+				"PINPIN_DIAL_TIMEOUT": "2s",
+				"PINPIN_IO_TIMEOUT":   "0",
+			},
+			want: connFlags{
+				address: "10.0.0.1:50000",
+				policy:  pinpin.RetryPolicy{Attempts: 5, Backoff: time.Second, MaxBackoff: 4 * time.Second, DialTimeout: 2 * time.Second},
+			},
+		},
+		{
+			name: "empty environment",
+			env:  map[string]string{"PINPIN_ADDRESS": "", "PINPIN_ATTEMPTS": ""},
+			want: connFlags{
+				address:   "192.168.4.1:50000",
+				policy:    pinpin.DefaultRetryPolicy,
+				ioTimeout: 30 * time.Second,
+			},
+		},
+		{
+			name: "flags over environment",
+			env:  map[string]string{"PINPIN_ADDRESS": "10.0.0.1:50000", "PINPIN_ATTEMPTS": "5", "PINPIN_IO_TIMEOUT": "1m"},
+			args: []string{"-address", "10.0.0.2:50000", "-attempts", "2", "-io-timeout", "5s", "-trace", "trace.jsonl"},
+			want: connFlags{
+				address:   "10.0.0.2:50000",
+				policy:    pinpin.RetryPolicy{Attempts: 2, Backoff: pinpin.DefaultRetryPolicy.Backoff, MaxBackoff: pinpin.DefaultRetryPolicy.MaxBackoff, DialTimeout: pinpin.DefaultRetryPolicy.DialTimeout},
+				ioTimeout: 5 * time.Second,
+				tracePath: "trace.jsonl",
+			},
+		},
+		{
+			name:          "library over default",
+			configAddress: "10.0.0.3:50000",
+			want: connFlags{
+				address:   "10.0.0.3:50000",
+				policy:    pinpin.DefaultRetryPolicy,
+				ioTimeout: 30 * time.Second,
+			},
+		},
+		{
+			name:          "environment over library",
+			env:           map[string]string{"PINPIN_ADDRESS": "10.0.0.1:50000"},
+			configAddress: "10.0.0.3:50000",
+			want: connFlags{
+				address:   "10.0.0.1:50000",
+				policy:    pinpin.DefaultRetryPolicy,
+				ioTimeout: 30 * time.Second,
+			},
+		},
+		{
+			name:          "flag over library",
+			args:          []string{"-address", "10.0.0.2:50000"},
+			configAddress: "10.0.0.3:50000",
+			want: connFlags{
+				address:   "10.0.0.2:50000",
+				policy:    pinpin.DefaultRetryPolicy,
+				ioTimeout: 30 * time.Second,
+			},
+		},
+		{
+			// even given the default value
+			name:          "default flag over library",
+			args:          []string{"-address", "192.168.4.1:50000"},
+			configAddress: "10.0.0.3:50000",
+			want: connFlags{
+				address:   "192.168.4.1:50000",
+				policy:    pinpin.DefaultRetryPolicy,
+				ioTimeout: 30 * time.Second,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{"PINPIN_ADDRESS", "PINPIN_ATTEMPTS", "PINPIN_BACKOFF", "PINPIN_MAX_BACKOFF", "PINPIN_DIAL_TIMEOUT", "PINPIN_IO_TIMEOUT"} {
+				t.Setenv(name, tc.env[name])
+			}
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			f, err := addConnFlags(fs)
+			require.NoError(t, err)
+			require.NoError(t, fs.Parse(tc.args))
+			f.setDefaultAddress(fs, tc.configAddress)
+			require.Equal(t, tc.want, *f)
+		})
+	}
+}
+
+func TestConnFlagsInvalidEnv(t *testing.T) {
+	for name, value := range map[string]string{
+		"PINPIN_ATTEMPTS":     "many",
+		"PINPIN_BACKOFF":      "1",
+		"PINPIN_MAX_BACKOFF":  "soon",
+		"PINPIN_DIAL_TIMEOUT": "1x",
+		"PINPIN_IO_TIMEOUT":   "-",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			_, err := addConnFlags(fs)
+			require.ErrorContains(t, err, "invalid $"+name+": ")
+		})
+	}
+
+	// all of them are reported
+	t.Setenv("PINPIN_ATTEMPTS", "many")
+	t.Setenv("PINPIN_IO_TIMEOUT", "-")
+	_, err := addConnFlags(flag.NewFlagSet("test", flag.ContinueOnError))
+	require.ErrorIs(t, err, strconv.ErrSyntax)
+	require.ErrorContains(t, err, "invalid $PINPIN_IO_TIMEOUT")
+
+	// a bad flag is reported by the flag set
+	t.Setenv("PINPIN_ATTEMPTS", "")
+	t.Setenv("PINPIN_IO_TIMEOUT", "")
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	_, err = addConnFlags(fs)
+	require.NoError(t, err)
+	require.Error(t, fs.Parse([]string{"-attempts", "many"}))
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gawen/pinpin"
+)
+
+// newDeviceFlagSet returns the flag set of a command talking to the Merlin,
+// with the connection flags.
+func newDeviceFlagSet(name string, arguments string) (*flag.FlagSet, *connFlags) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [flags] %s\n", os.Args[0], name, arguments)
+		fs.PrintDefaults()
+	}
+	return fs, mustAddConnFlags(fs)
+}
+
+func mustConnect(ctx context.Context, cflags *connFlags, opts ...pinpin.Option) (*pinpin.Session, io.Closer) {
+	session, closer, err := cflags.connect(ctx, opts...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+	return session, closer
+}
+
+func runLs(ctx context.Context, args []string) {
+	fs, cflags := newDeviceFlagSet("ls", "")
+	withSha256 := fs.Bool("sha256", false, "also show the SHA256 of the files, computed by the Merlin")
+	fs.Parse(args)
+
+	session, closer := mustConnect(ctx, cflags)
+	defer closer.Close()
+
+	if err := listFiles(ctx, session, *withSha256, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to list files in Merlin: %s\n", err.Error())
+		os.Exit(-1)
+	}
+}
+
+// listFiles writes the size and the path of the files of the Merlin to `w`,
+// and their SHA256 if `withSha256` is set.
+func listFiles(ctx context.Context, session *pinpin.Session, withSha256 bool, w io.Writer) error {
+	var fis []*pinpin.FileInformation
+	if err := session.Do(ctx, func(ctx context.Context, c *pinpin.Conn) error {
+		fis = nil
+
+		fileCount, err := c.GetNumberOfFilesContext(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to get file count: %w", err)
+		}
+
+		for idx := range fileCount {
+			fi, err := c.GetFileInformationContext(ctx, idx, withSha256)
+			if err != nil {
+				return fmt.Errorf("unable to get file #%d's information: %w", idx, err)
+			}
+			fis = append(fis, fi)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, fi := range fis {
+		if withSha256 {
+			fmt.Fprintf(w, "%10d  %s  %s\n", fi.Size, hex.EncodeToString(fi.Sha256), fi.Path)
+		} else {
+			fmt.Fprintf(w, "%10d  %s\n", fi.Size, fi.Path)
+		}
+	}
+	return nil
+}
+
+func runGet(ctx context.Context, args []string) {
+	fs, cflags := newDeviceFlagSet("get", "<remote path> [local path, or - for stdout]")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	remotePath := fs.Arg(0)
+	localPath := filepath.Base(remotePath)
+	if fs.NArg() == 2 {
+		localPath = fs.Arg(1)
+	}
+
+	session, closer := mustConnect(ctx, cflags, pinpin.WithProgressReporter(pinpin.NewProgressBarReporter()))
+	defer closer.Close()
+
+	// created once connected, not to overwrite a previous download for nothing
+	out := os.Stdout
+	if localPath != "-" {
+		var err error
+		out, err = os.Create(localPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to create '%s': %s\n", localPath, err.Error())
+			os.Exit(-1)
+		}
+		defer out.Close()
+	}
+
+	if err := getFile(ctx, session, remotePath, out); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		if out != os.Stdout {
+			out.Close()
+			os.Remove(localPath)
+		}
+		os.Exit(-1)
+	}
+}
+
+// getFile downloads `remotePath` to `out`. A local file is started over after
+// a failed attempt, while another writer, such as stdout, cannot be: the file
+// is buffered and written to it once complete.
+func getFile(ctx context.Context, session *pinpin.Session, remotePath string, out io.Writer) error {
+	file, isFile := out.(*os.File)
+	isFile = isFile && file != os.Stdout
+
+	var buf bytes.Buffer
+	if err := session.Do(ctx, func(ctx context.Context, c *pinpin.Conn) error {
+		if !isFile {
+			buf.Reset()
+			return c.GetFileContext(ctx, remotePath, &buf)
+		}
+
+		// start over after a failed attempt
+		if err := file.Truncate(0); err != nil {
+			return err
+		} else if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return c.GetFileContext(ctx, remotePath, file)
+	}); err != nil {
+		return fmt.Errorf("unable to get '%s': %w", remotePath, err)
+	}
+
+	if !isFile {
+		if _, err := buf.WriteTo(out); err != nil {
+			return fmt.Errorf("unable to write '%s': %w", remotePath, err)
+		}
+	}
+	return nil
+}
+
+func runPut(ctx context.Context, args []string) {
+	fs, cflags := newDeviceFlagSet("put", "<local path> [remote path]")
+	fs.Parse(args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	localPath := fs.Arg(0)
+	remotePath := filepath.Base(localPath)
+	if fs.NArg() == 2 {
+		remotePath = fs.Arg(1)
+	}
+
+	session, closer := mustConnect(ctx, cflags, pinpin.WithProgressReporter(pinpin.NewProgressBarReporter()))
+	defer closer.Close()
+
+	if err := putFile(ctx, session, localPath, remotePath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+}
+
+// putFile uploads the local file at `localPath` to `remotePath`.
+func putFile(ctx context.Context, session *pinpin.Session, localPath string, remotePath string) error {
+	if err := session.UploadLocaFile(ctx, remotePath, localPath); err != nil {
+		return fmt.Errorf("unable to transfer file '%s': %w", remotePath, err)
+	}
+	return nil
+}
+
+func runInfo(ctx context.Context, args []string) {
+	fs, cflags := newDeviceFlagSet("info", "")
+	fs.Parse(args)
+
+	session, closer := mustConnect(ctx, cflags)
+	defer closer.Close()
+
+	if err := printInfo(ctx, session, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+}
+
+// printInfo writes the size of the SD card and the number of files to `w`.
+func printInfo(ctx context.Context, session *pinpin.Session, w io.Writer) error {
+	var sdSize uint32
+	var fileCount uint16
+	if err := session.Do(ctx, func(ctx context.Context, c *pinpin.Conn) (err error) {
+		if sdSize, err = c.GetSDSizeContext(ctx); err != nil {
+			return fmt.Errorf("unable to get SD size: %w", err)
+		} else if fileCount, err = c.GetNumberOfFilesContext(ctx); err != nil {
+			return fmt.Errorf("unable to get file count: %w", err)
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "SD size: %dB (%.1f GiB)\n", sdSize, float64(sdSize)/(1<<30))
+	fmt.Fprintf(w, "files:   %d\n", fileCount)
+	return nil
+}
+
+func runPing(ctx context.Context, args []string) {
+	fs, cflags := newDeviceFlagSet("ping", "")
+	fs.Parse(args)
+
+	session, closer := mustConnect(ctx, cflags)
+	defer closer.Close()
+
+	if err := ping(ctx, session, cflags.address, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+}
+
+// ping writes to `w` how long the Merlin at `address` took to answer.
+func ping(ctx context.Context, session *pinpin.Session, address string, w io.Writer) error {
+	start := time.Now()
+	if err := session.Do(ctx, func(ctx context.Context, c *pinpin.Conn) error {
+		start = time.Now()
+		return c.PingContext(ctx)
+	}); err != nil {
+		return fmt.Errorf("unable to ping: %w", err)
+	}
+
+	fmt.Fprintf(w, "pong from %s in %s\n", address, time.Since(start).Round(time.Microsecond))
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+// newDeviceTest returns a session to the Merlin at `address`, counting its
+// retries.
+func newDeviceTest(t *testing.T, address string) (*pinpin.Session, *int) {
+	t.Helper()
+
+	session := pinpin.NewSession(address, pinpin.RetryPolicy{Attempts: 2, Backoff: time.Millisecond, DialTimeout: time.Second})
+	t.Cleanup(func() { session.Close() })
+
+	retries := new(int)
+	session.OnRetry = func(int, error) { *retries++ }
+	return session, retries
+}
+
+// serveCutTest serves `device` on a local port until the end of the test. The
+// first connection is cut once `cut` bytes were sent to the client.
+func serveCutTest(t *testing.T, device *sim.Device, cut int) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for first := true; ; first = false {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			var rw io.ReadWriter = conn
+			if first {
+				rw = &cutConn{conn, cut}
+			}
+			go func() {
+				defer conn.Close()
+				device.ServeConn(rw)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+type cutConn struct {
+	net.Conn
+	left int
+}
+
+func (c *cutConn) Write(b []byte) (int, error) {
+	if len(b) <= c.left {
+		c.left -= len(b)
+		return c.Conn.Write(b)
+	}
+
+	n, _ := c.Conn.Write(b[:c.left])
+	c.left = 0
+	c.Conn.Close()
+	return n, net.ErrClosed
+}
+
+func TestListFiles(t *testing.T) {
+	device, address := simtest.Serve(t)
+	session, _ := newDeviceTest(t, address)
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	require.NoError(t, listFiles(ctx, session, false, &out))
+	require.Empty(t, out.String())
+
+	require.NoError(t, device.Storage.WriteFile("story.mp3", []byte("mp3")))
+	require.NoError(t, device.Storage.WriteFile("cover.jpg", []byte("jpeg!")))
+
+	out.Reset()
+	require.NoError(t, listFiles(ctx, session, false, &out))
+	require.ElementsMatch(t, []string{
+		"         3  story.mp3",
+		"         5  cover.jpg",
+	}, strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"))
+
+	mp3Sum := sha256.Sum256([]byte("mp3"))
+	jpegSum := sha256.Sum256([]byte("jpeg!"))
+	out.Reset()
+	require.NoError(t, listFiles(ctx, session, true, &out))
+	require.ElementsMatch(t, []string{
+		"         3  " + hex.EncodeToString(mp3Sum[:]) + "  story.mp3",
+		"         5  " + hex.EncodeToString(jpegSum[:]) + "  cover.jpg",
+	}, strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n"))
+}
+
+func TestGetFile(t *testing.T) {
+	device, address := simtest.Serve(t)
+	session, _ := newDeviceTest(t, address)
+	data := bytes.Repeat([]byte("pinpin"), 1000)
+	require.NoError(t, device.Storage.WriteFile("story.mp3", data))
+	ctx := context.Background()
+
+	// to a file, replacing what it held
+	localPath := filepath.Join(t.TempDir(), "story.mp3")
+	require.NoError(t, os.WriteFile(localPath, bytes.Repeat([]byte("old"), 10000), 0o644))
+	out, err := os.OpenFile(localPath, os.O_RDWR, 0)
+	require.NoError(t, err)
+	defer out.Close()
+	require.NoError(t, getFile(ctx, session, "story.mp3", out))
+	got, err := os.ReadFile(localPath)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	// to another writer
+	var buf bytes.Buffer
+	require.NoError(t, getFile(ctx, session, "story.mp3", &buf))
+	require.Equal(t, data, buf.Bytes())
+
+	err = getFile(ctx, session, "missing.mp3", &buf)
+	require.ErrorContains(t, err, "unable to get 'missing.mp3'")
+	var statusErr *pinpin.StatusError
+	require.ErrorAs(t, err, &statusErr)
+}
+
+func TestGetFileRetried(t *testing.T) {
+	device := sim.NewDevice(sim.NewMemoryStorage())
+	data := bytes.Repeat([]byte("pinpin"), 1000)
+	require.NoError(t, device.Storage.WriteFile("story.mp3", data))
+	ctx := context.Background()
+
+	// the first attempt stops halfway: the file is started over
+	session, retries := newDeviceTest(t, serveCutTest(t, device, len(data)/2))
+	localPath := filepath.Join(t.TempDir(), "story.mp3")
+	out, err := os.Create(localPath)
+	require.NoError(t, err)
+	defer out.Close()
+	require.NoError(t, getFile(ctx, session, "story.mp3", out))
+	got, err := os.ReadFile(localPath)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+	require.Equal(t, 1, *retries)
+
+	// and another writer only gets the complete file
+	session, retries = newDeviceTest(t, serveCutTest(t, device, len(data)/2))
+	w := &recordingWriter{}
+	require.NoError(t, getFile(ctx, session, "story.mp3", w))
+	require.Equal(t, [][]byte{data}, w.writes)
+	require.Equal(t, 1, *retries)
+}
+
+// recordingWriter records each write.
+type recordingWriter struct {
+	writes [][]byte
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, bytes.Clone(b))
+	return len(b), nil
+}
+
+func TestPutFile(t *testing.T) {
+	device, address := simtest.Serve(t)
+	session, _ := newDeviceTest(t, address)
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("pinpin"), 1000)
+	localPath := filepath.Join(t.TempDir(), "story.mp3")
+	require.NoError(t, os.WriteFile(localPath, data, 0o644))
+	require.NoError(t, putFile(ctx, session, localPath, "other.mp3"))
+	got, err := device.Storage.ReadFile("other.mp3")
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+
+	err = putFile(ctx, session, filepath.Join(t.TempDir(), "missing.mp3"), "missing.mp3")
+	require.ErrorContains(t, err, "unable to transfer file 'missing.mp3'")
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestPrintInfo(t *testing.T) {
+	device, address := simtest.Serve(t)
+	session, _ := newDeviceTest(t, address)
+	require.NoError(t, device.Storage.WriteFile("story.mp3", []byte("mp3")))
+
+	var out bytes.Buffer
+	require.NoError(t, printInfo(context.Background(), session, &out))
+	require.Regexp(t, `^SD size: \d+B \(\d+\.\d GiB\)\nfiles:   1\n$`, out.String())
+}
+
+func TestPing(t *testing.T) {
+	_, address := simtest.Serve(t)
+	session, _ := newDeviceTest(t, address)
+
+	var out bytes.Buffer
+	require.NoError(t, ping(context.Background(), session, address, &out))
+	require.Regexp(t, `^pong from `+regexp.QuoteMeta(address)+` in \S+s\n$`, out.String())
+
+	// nothing listens
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address = l.Addr().String()
+	l.Close()
+	session, _ = newDeviceTest(t, address)
+
+	out.Reset()
+	require.ErrorContains(t, ping(context.Background(), session, address, &out), "unable to ping")
+	require.Empty(t, out.String())
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"errors"
 	"flag"
@@ -10,194 +11,89 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strings"
-	"time"
 
 	"github.com/gawen/pinpin"
 	"github.com/google/uuid"
-	"github.com/schollz/progressbar/v3"
 )
 
 func main() {
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: %s <path to library to upload>\n", os.Args[0])
-	}
-
-	flag.Parse()
-	libraryPath := flag.Arg(0)
-
-	cachePath := filepath.Join(libraryPath, ".cache")
-	_ = os.Mkdir(cachePath, 0755)
-	libraryNodes, err := readLibrary(libraryPath, cachePath)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to read library to upload: %s\n", err.Error())
-		return
-	}
-
-	fmt.Fprintf(os.Stderr, "🎧 Library read!\n")
-	for firstIdx, firstNode := range libraryNodes {
-		fmt.Fprintf(os.Stderr, "%d. %s\n", firstIdx+1, firstNode.Title)
-		for secondIdx, secondNode := range firstNode.Children {
-			fmt.Fprintf(os.Stderr, "  %d. %s\n", secondIdx+1, secondNode.Title)
-		}
-	}
-	fmt.Fprintf(os.Stderr, "\n")
-
-	fmt.Fprintf(os.Stderr, "🛜 connecting to the Merlin...\n")
-	fmt.Fprintf(os.Stderr, "ℹ️ set your Merlin in mode 'TRANSFERT', search for a Wi-Fi network named 'MERLIN_' and connect to it with password 'MERLIN_APP'.\n")
-	var conn *pinpin.Conn
-	for range 10 {
-		var err error
-		conn, err = pinpin.DialTimeout("192.168.4.1:50000", 5*time.Second)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "unable to connect: %s\n", err.Error())
-			time.Sleep(time.Second)
-			continue
-		}
-
-		if err := conn.Ping(); err != nil {
-			conn.Close()
-			fmt.Fprintf(os.Stderr, "unable to ping: %s\n", err.Error())
-			time.Sleep(time.Second)
-			continue
-		}
-
-		break
-	}
-	if conn == nil {
-		return
-	}
-	defer conn.Close()
-
-	fmt.Fprintf(os.Stderr, "🛜 connected ✅\n")
-
-	// list already existing files
-	fileCount, err := conn.GetNumberOfFiles()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to get file count in Merlin: %s", err.Error())
-		os.Exit(-1)
-	}
-
-	existingFileSize := make(map[string]uint32)
-	listProg := progressbar.Default(int64(fileCount), "listing files...")
-	for idx := range fileCount {
-		fi, err := conn.GetFileInformation(idx, false)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "unable to get file #%d's information in Merlin: %s", idx, err.Error())
-			os.Exit(-1)
-		}
-
-		existingFileSize[fi.Path] = fi.Size
-		listProg.Add(1)
-	}
-	listProg.Close()
-
-	// list & transfer missing files
-	var transferFiles []string
-	for _, firstNode := range libraryNodes {
-		transferFiles = append(transferFiles,
-			firstNode.UUID+".jpg",
-		)
-		for _, secondNode := range firstNode.Children {
-			transferFiles = append(transferFiles,
-				secondNode.UUID+".mp3",
-				secondNode.UUID+".jpg",
-			)
-		}
-	}
-
-	for _, remoteFilePath := range transferFiles {
-		localFilePath := filepath.Join(cachePath, remoteFilePath)
-		fi, err := os.Stat(localFilePath)
-		if err != nil {
-			panic(err)
-		}
-
-		if size, has := existingFileSize[remoteFilePath]; has && size == uint32(fi.Size()) {
-			continue
-		}
-
-		if err := conn.UploadLocaFile(remoteFilePath, localFilePath); err != nil {
-			fmt.Fprintf(os.Stderr, "unable to transfer file '%s': %s", remoteFilePath, err.Error())
-			os.Exit(-1)
-		}
-	}
-
-	// get playlist
-	var playlistBin bytes.Buffer
-	if err := conn.GetFile("playlist.bin", &playlistBin); err != nil {
-		fmt.Fprintf(os.Stderr, "unable to get 'playlist.bin': %s\n", err.Error())
-		os.Exit(-1)
-	}
+	flag.Usage = usage
 
-	playlistItems, err := pinpin.DecodePlaylistBin(playlistBin.Bytes())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to decode 'playlist.bin': %s\n", err.Error())
+	if len(os.Args) < 2 {
+		usage()
 		os.Exit(-1)
 	}
 
-	oldTree, err := pinpin.BuildPlaylistTree(playlistItems)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to process `playlist.bin`: %s\n", err.Error())
-		os.Exit(-1)
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "sync":
+		runSync(ctx, args)
+	case "plan":
+		runPlan(ctx, args)
+	case "apply":
+		runApply(ctx, args)
+	case "ls":
+		runLs(ctx, args)
+	case "get":
+		runGet(ctx, args)
+	case "put":
+		runPut(ctx, args)
+	case "info":
+		runInfo(ctx, args)
+	case "ping":
+		runPing(ctx, args)
+	case "proxy":
+		runProxy(args)
+	case "playlist":
+		runPlaylist(args)
+	case "help", "-h", "-help", "--help":
+		usage()
+	default:
+		// `pinpin [flags] <library>` predates the subcommands
+		runSync(ctx, os.Args[1:])
 	}
+}
 
-	// replace old pinpin nodes new ones
-	var newTree []*pinpin.PlaylistTreeNode
-	for _, node := range oldTree {
-		u, err := uuid.Parse(node.UUID)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "unable to parse UUID '%s'. ignore\n", node.UUID)
-			newTree = append(newTree, node)
-			continue
-		}
-
-		// remove node if it is from pinpin
-		if !isPinpinUUID(u) {
-			newTree = append(newTree, node)
-		}
-	}
-
-	newTree = append(newTree, libraryNodes...)
-
-	playlistJsonRaw, err := pinpin.MarshalPlaylistJson(newTree)
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] [arguments]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "\ncommands:\n")
+	fmt.Fprintf(os.Stderr, "  sync <library>               upload a library and add it to the playlist\n")
+	fmt.Fprintf(os.Stderr, "  plan -o plan.json <library>  save what a sync would do\n")
+	fmt.Fprintf(os.Stderr, "  apply <plan.json>            run a saved plan\n")
+	fmt.Fprintf(os.Stderr, "  ls                           list the files of the Merlin\n")
+	fmt.Fprintf(os.Stderr, "  get <remote> [local]         download a file from the Merlin\n")
+	fmt.Fprintf(os.Stderr, "  put <local> [remote]         upload a file to the Merlin\n")
+	fmt.Fprintf(os.Stderr, "  info                         show the SD card size and the number of files\n")
+	fmt.Fprintf(os.Stderr, "  ping                         check the Merlin answers\n")
+	fmt.Fprintf(os.Stderr, "  proxy                        dissect the exchanges between a client and the Merlin\n")
+	fmt.Fprintf(os.Stderr, "  playlist dump <file>         inspect a playlist.bin\n")
+	fmt.Fprintf(os.Stderr, "\nrun '%s <command> -h' for the flags of a command.\n", os.Args[0])
+}
 
+// readLibrary reads the library at `basePath` and its `pinpin.yaml`, which is
+// validated before anything is transcoded to `cachePath`.
+func readLibrary(basePath string, cachePath string) ([]*pinpin.PlaylistTreeNode, *libraryConfig, error) {
+	config, err := readLibraryConfig(basePath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "unable to generate `playlist.json`: %s\n", err.Error())
-		os.Exit(-1)
-	}
-
-	if err := conn.UploadBytes("playlist.json", playlistJsonRaw); err != nil {
-		fmt.Fprintf(os.Stderr, "unable to upload `playlist.json`: %s\n", err.Error())
-		os.Exit(-1)
+		return nil, nil, err
 	}
 
-	if err := conn.UpdatePlaylist("playlist.json"); err != nil {
-		fmt.Fprintf(os.Stderr, "unable to apply `playlist.json`: %s\n", err.Error())
-		os.Exit(-1)
-	}
-
-	if err := conn.EndSynchronization(); err != nil {
-		panic(err)
-	}
-
-	fmt.Fprintf(os.Stderr, "✅ transfered!\n")
-}
-
-func readLibrary(basePath string, cachePath string) ([]*pinpin.PlaylistTreeNode, error) {
-
 	firstEntries, err := os.ReadDir(basePath)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var nodes []*pinpin.PlaylistTreeNode
 	for _, firstEntry := range firstEntries {
 		firstName := firstEntry.Name()
-		if strings.HasPrefix(firstName, ".") {
+		if strings.HasPrefix(firstName, ".") || firstName == libraryConfigName || config.excluded(firstName) {
 			continue
 		}
 		firstPath := filepath.Join(basePath, firstName)
@@ -215,7 +111,7 @@ func readLibrary(basePath string, cachePath string) ([]*pinpin.PlaylistTreeNode,
 
 		secondEntries, err := os.ReadDir(firstPath)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		firstTitle, _ := strings.CutSuffix(firstName, filepath.Ext(firstName))
@@ -229,23 +125,31 @@ func readLibrary(basePath string, cachePath string) ([]*pinpin.PlaylistTreeNode,
 		firstNode.UUID = firstUUID.String()
 		firstNode.Title = firstTitle
 		firstNode.AddTimeUnix = uint32(firstEntryInfo.ModTime().Unix())
-
-		// pick an image
-		// TODO allow to pick any image
-		if fh, err := os.Create(filepath.Join(cachePath, firstUUID.String()+".jpg")); err != nil {
+		setLibraryNodeFlags(firstNode, config, firstName)
+
+		// pick an image, unless the folder has a cover
+		image := pickAssetJpegRaw(firstUUID[:])
+		coverPath, hasCover := config.Covers[firstName]
+		if hasCover {
+			if image, err = os.ReadFile(coverPath); err != nil {
+				fmt.Fprintf(os.Stderr, "unable to read cover of '%s': %s\n", firstPath, err.Error())
+				continue
+			}
+		}
+		if err := os.WriteFile(filepath.Join(cachePath, firstUUID.String()+".jpg"), image, 0644); err != nil {
 			fmt.Fprintf(os.Stderr, "unable to write image for '%s': %s\n", firstPath, err.Error())
 			continue
-		} else {
-			fh.Write(pickAssetJpegRaw(firstUUID[:]))
-			fh.Close()
 		}
 
 		for _, secondEntry := range secondEntries {
 			secondName := secondEntry.Name()
-			if strings.HasPrefix(secondName, ".") {
+			if strings.HasPrefix(secondName, ".") || config.excluded(firstName+"/"+secondName) {
 				continue
 			}
 			secondPath := filepath.Join(firstPath, secondName)
+			if hasCover && secondPath == coverPath {
+				continue
+			}
 
 			secondEntryInfo, err := secondEntry.Info()
 			if err != nil {
@@ -267,7 +171,7 @@ func readLibrary(basePath string, cachePath string) ([]*pinpin.PlaylistTreeNode,
 			switch strings.ToLower(filepath.Ext(secondName)) {
 			case ".mp3", ".mp4", ".webm", ".m4a", ".wav", ".opus":
 				// derive UUID
-				secondUUID, err := filePinpinUUID(secondPath)
+				secondUUID, err := filePinpinUUID(secondPath, config.Transcode.uuidSalt())
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "unable to derive UUID from '%s': %s\n", secondPath, err.Error())
 					continue
@@ -278,15 +182,7 @@ func readLibrary(basePath string, cachePath string) ([]*pinpin.PlaylistTreeNode,
 				if _, err := os.Stat(secondTranscodedPath); err != nil {
 					_ = os.Remove(secondTranscodedPath)
 					fmt.Fprintf(os.Stderr, "transcoding '%s'...\n", secondPath)
-					if err := runFfmpeg("-i", secondPath,
-						"-map", "0:a:0",
-						"-c:a", "libmp3lame",
-						"-b:a", "128k",
-						"-ar", "44100",
-						"-ac", "2",
-						"-sample_fmt", "fltp",
-						secondTranscodedPath,
-					); err != nil {
+					if err := runFfmpeg(config.Transcode.ffmpegArgs(secondPath, secondTranscodedPath)...); err != nil {
 						fmt.Fprintf(os.Stderr, "unable to transcode '%s': %s\n", secondPath, err.Error())
 						continue
 					}
@@ -306,6 +202,7 @@ func readLibrary(basePath string, cachePath string) ([]*pinpin.PlaylistTreeNode,
 				secondNode.UUID = secondUUID.String()
 				secondNode.Title = secondTitle
 				secondNode.AddTimeUnix = uint32(secondEntryInfo.ModTime().Unix())
+				setLibraryNodeFlags(secondNode, config, firstName+"/"+secondName)
 
 				firstNode.Children = append(firstNode.Children, secondNode)
 
@@ -314,19 +211,36 @@ func readLibrary(basePath string, cachePath string) ([]*pinpin.PlaylistTreeNode,
 			}
 		}
 		if len(firstNode.Children) > 0 {
-			sort.Slice(firstNode.Children, func(i, j int) bool {
-				return firstNode.Children[i].AddTimeUnix > firstNode.Children[j].AddTimeUnix
-			})
-
+			sortLibraryNodes(firstNode.Children, config.Sort)
 			nodes = append(nodes, firstNode)
 		}
 	}
 
-	sort.Slice(nodes, func(i, j int) bool {
-		return nodes[i].AddTimeUnix > nodes[j].AddTimeUnix
-	})
+	sortLibraryNodes(nodes, config.Sort)
+
+	return nodes, config, nil
+}
+
+func setLibraryNodeFlags(node *pinpin.PlaylistTreeNode, config *libraryConfig, path string) {
+	if config.favorite(path) {
+		node.Favorite = 1
+	}
+	if config.discover(path) {
+		node.Discover = 1
+	}
+}
 
-	return nodes, nil
+func sortLibraryNodes(nodes []*pinpin.PlaylistTreeNode, order string) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		switch order {
+		case librarySortOldest:
+			return nodes[i].AddTimeUnix < nodes[j].AddTimeUnix
+		case librarySortTitle:
+			return nodes[i].Title < nodes[j].Title
+		default:
+			return nodes[i].AddTimeUnix > nodes[j].AddTimeUnix
+		}
+	})
 }
 
 func checkTitle(title string) error {
@@ -338,7 +252,7 @@ func checkTitle(title string) error {
 	return nil
 }
 
-func filePinpinUUID(path string) (uuid.UUID, error) {
+func filePinpinUUID(path string, salt string) (uuid.UUID, error) {
 	fh, err := os.Open(path)
 	if err != nil {
 		return uuid.UUID{}, err
@@ -349,6 +263,7 @@ func filePinpinUUID(path string) (uuid.UUID, error) {
 	if _, err := io.Copy(hasher, fh); err != nil {
 		return uuid.UUID{}, err
 	}
+	hasher.Write([]byte(salt))
 
 	return digestPinpinUUID(hasher.Sum(nil)), nil
 }
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/gawen/pinpin"
+)
+
+func runPlan(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s plan [flags] <path to library to upload>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	cflags := mustAddConnFlags(fs)
+	outPath := fs.String("o", "plan.json", "file to write the plan to, - for stdout")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	lib := mustReadLibrary(fs.Arg(0))
+	cflags.setDefaultAddress(fs, lib.config.Address)
+	session, closer := mustConnectSync(ctx, cflags)
+	defer closer.Close()
+
+	plan, err := planSync(ctx, session, lib)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+	printPlaylistDiff(plan.Diff, false)
+	fmt.Fprintf(os.Stderr, "📦 %d files to upload\n", len(plan.Uploads))
+
+	raw, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to encode plan: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	raw = append(raw, '\n')
+
+	if *outPath == "-" {
+		_, err = os.Stdout.Write(raw)
+	} else {
+		err = os.WriteFile(*outPath, raw, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to write plan: %s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	if *outPath != "-" {
+		fmt.Fprintf(os.Stderr, "✅ plan written to '%s', run '%s apply %s' to apply it\n", *outPath, os.Args[0], *outPath)
+	}
+}
+
+func runApply(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s apply [flags] <plan.json>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	cflags := mustAddConnFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	plan, err := readSyncPlan(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read plan: %s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	// check the library first, it does not need the Merlin
+	for _, upload := range plan.Uploads {
+		checksum, err := hashLocalFile(upload.LocalPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to read '%s': %s\n", upload.LocalPath, err.Error())
+			os.Exit(-1)
+		} else if checksum != upload.Sha256 {
+			fmt.Fprintf(os.Stderr, "'%s' changed since the plan was made, run plan again\n", upload.LocalPath)
+			os.Exit(-1)
+		}
+	}
+
+	cflags.setDefaultAddress(fs, plan.Address)
+	session, closer := mustConnectSync(ctx, cflags)
+	defer closer.Close()
+
+	if err := verifySyncPlan(ctx, session, plan); err != nil {
+		fmt.Fprintf(os.Stderr, "the Merlin changed since the plan was made, run plan again: %s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	printPlaylistDiff(plan.Diff, false)
+	if err := applySync(ctx, session, plan); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	fmt.Fprintf(os.Stderr, "✅ transfered!\n")
+}
+
+func readSyncPlan(path string) (*syncPlan, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := new(syncPlan)
+	if err := json.Unmarshal(raw, plan); err != nil {
+		return nil, err
+	} else if plan.Version != syncPlanVersion {
+		return nil, fmt.Errorf("unsupported plan version %d, expected %d", plan.Version, syncPlanVersion)
+	} else if len(plan.Playlist) == 0 {
+		return nil, errors.New("empty playlist")
+	}
+
+	return plan, nil
+}
+
+// verifySyncPlan checks the Merlin still has the files and the playlist the
+// plan was made with.
+func verifySyncPlan(ctx context.Context, session *pinpin.Session, plan *syncPlan) error {
+	existingFileSize, err := listDeviceFiles(ctx, session)
+	if err != nil {
+		return fmt.Errorf("unable to list files in Merlin: %w", err)
+	}
+
+	for _, file := range plan.Existing {
+		if size, has := existingFileSize[file.Path]; !has {
+			return fmt.Errorf("file '%s' is missing", file.Path)
+		} else if int64(size) != file.Size {
+			return fmt.Errorf("file '%s' is %dB, expected %dB", file.Path, size, file.Size)
+		}
+
+		if file.Sha256 == "" {
+			continue
+		}
+
+		// a cover of the same size may have been swapped
+		checksum, err := getDeviceFileSha256(ctx, session, file.Path)
+		if err != nil {
+			return err
+		} else if checksum != file.Sha256 {
+			return fmt.Errorf("file '%s' changed", file.Path)
+		}
+	}
+
+	playlistBin, err := getDevicePlaylistBin(ctx, session)
+	if err != nil {
+		return err
+	} else if hashBytes(playlistBin) != plan.PlaylistBinSha256 {
+		return errors.New("'playlist.bin' changed")
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+// writeSyncPlanTest plans a sync of `lib` and writes it as `pinpin plan` does.
+func writeSyncPlanTest(t *testing.T, session *pinpin.Session, lib *library) string {
+	t.Helper()
+
+	plan, err := planSync(context.Background(), session, lib)
+	require.NoError(t, err)
+	raw, err := json.MarshalIndent(plan, "", "  ")
+	require.NoError(t, err)
+
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	require.NoError(t, os.WriteFile(planPath, raw, 0o644))
+	return planPath
+}
+
+func TestApplyChecksDevice(t *testing.T) {
+	session, lib, files := newSyncTest(t)
+	ctx := context.Background()
+
+	for path, data := range files {
+		require.NoError(t, session.UploadReadSeeker(ctx, path, bytes.NewReader(data)))
+	}
+	plan, err := readSyncPlan(writeSyncPlanTest(t, session, lib))
+	require.NoError(t, err)
+	require.Len(t, plan.Existing, len(files))
+	require.NoError(t, verifySyncPlan(ctx, session, plan))
+
+	// the folder cover, compared by hash
+	coverPath := "0b1b5f3e-0000-4000-8000-000000000001.jpg"
+	var cover plannedExisting
+	for _, file := range plan.Existing {
+		if file.Path == coverPath {
+			cover = file
+		}
+	}
+	require.Equal(t, hashBytes(files[coverPath]), cover.Sha256)
+
+	// another cover of the same size
+	require.NoError(t, session.UploadReadSeeker(ctx, coverPath, bytes.NewReader([]byte("other  cover"))))
+	require.ErrorContains(t, verifySyncPlan(ctx, session, plan), "file '"+coverPath+"' changed")
+	require.NoError(t, session.UploadReadSeeker(ctx, coverPath, bytes.NewReader(files[coverPath])))
+	require.NoError(t, verifySyncPlan(ctx, session, plan))
+
+	// another playlist
+	playlistBin, err := pinpin.EncodePlaylistBin([]pinpin.PlaylistItem{{ID: 1, Kind: pinpin.PlaylistItemKindRoot, Title: "other"}})
+	require.NoError(t, err)
+	require.NoError(t, session.UploadReadSeeker(ctx, "playlist.bin", bytes.NewReader(playlistBin)))
+	require.ErrorContains(t, verifySyncPlan(ctx, session, plan), "'playlist.bin' changed")
+
+	// the files are gone
+	_, address := simtest.Serve(t)
+	emptySession := pinpin.NewSession(address, pinpin.RetryPolicy{Attempts: 1, DialTimeout: time.Second})
+	defer emptySession.Close()
+	require.ErrorContains(t, verifySyncPlan(ctx, emptySession, plan), "is missing")
+}
+
+func TestApplySync(t *testing.T) {
+	session, lib, files := newSyncTest(t)
+	ctx := context.Background()
+
+	plan, err := readSyncPlan(writeSyncPlanTest(t, session, lib))
+	require.NoError(t, err)
+	require.Len(t, plan.Uploads, len(files))
+	require.NoError(t, verifySyncPlan(ctx, session, plan))
+	require.NoError(t, applySync(ctx, session, plan))
+
+	// the plan is outdated once applied
+	require.ErrorContains(t, verifySyncPlan(ctx, session, plan), "'playlist.bin' changed")
+
+	playlistBin, err := getDevicePlaylistBin(ctx, session)
+	require.NoError(t, err)
+	items, err := pinpin.DecodePlaylistBin(playlistBin)
+	require.NoError(t, err)
+	nodes, err := pinpin.BuildPlaylistTree(items)
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	require.Equal(t, lib.nodes[0].UUID, nodes[0].UUID)
+}
+
+func TestSyncPlanDiff(t *testing.T) {
+	oldTree := []*pinpin.PlaylistTreeNode{{
+		UUID:  "folder",
+		Title: "Cuentos",
+		Children: []*pinpin.PlaylistTreeNode{
+			{UUID: "gato", Title: "El gato"},
+			{UUID: "loup", Title: "Le loup"},
+		},
+	}}
+	newTree := []*pinpin.PlaylistTreeNode{{
+		UUID:  "folder",
+		Title: "Contes",
+		Children: []*pinpin.PlaylistTreeNode{
+			{UUID: "loup", Title: "Le loup", Favorite: 1},
+			{UUID: "gato", Title: "El gato"},
+		},
+	}}
+
+	// written as `pinpin plan` does
+	raw, err := json.MarshalIndent(&syncPlan{
+		Version:  syncPlanVersion,
+		Playlist: newTree,
+		Diff:     pinpin.DiffPlaylistTrees(oldTree, newTree),
+	}, "", "  ")
+	require.NoError(t, err)
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	require.NoError(t, os.WriteFile(planPath, raw, 0o644))
+
+	// the values are read back with their type
+	plan, err := readSyncPlan(planPath)
+	require.NoError(t, err)
+	text := func(s string) pinpin.PlaylistChangeValue { return pinpin.PlaylistChangeValue{Text: s} }
+	number := func(n int) pinpin.PlaylistChangeValue { return pinpin.PlaylistChangeValue{Number: n, IsNumber: true} }
+	require.Equal(t, pinpin.PlaylistDiff{
+		{Kind: pinpin.PlaylistChangeRetitled, UUID: "folder", Path: "/Contes", From: text("Cuentos"), To: text("Contes")},
+		{Kind: pinpin.PlaylistChangeFavorite, UUID: "loup", Path: "/Contes/Le loup", From: number(0), To: number(1)},
+		{Kind: pinpin.PlaylistChangeReordered, UUID: "gato", Path: "/Contes/El gato", From: number(0), To: number(1)},
+	}, plan.Diff)
+	require.Equal(t, "favorite  /Contes/Le loup: 0 → 1\n", plan.Diff[1:2].String())
+}
+
+func TestReadSyncPlan(t *testing.T) {
+	dir := t.TempDir()
+	for name, raw := range map[string]string{
+		"version": `{"version": 1, "playlist": [{"uuid": "story"}]}`,
+		"empty":   `{"version": 2, "playlist": []}`,
+		"invalid": `{"version": 2,`,
+	} {
+		path := filepath.Join(dir, name+".json")
+		require.NoError(t, os.WriteFile(path, []byte(raw), 0o644))
+
+		_, err := readSyncPlan(path)
+		require.Error(t, err, name)
+	}
+
+	_, err := readSyncPlan(filepath.Join(dir, "missing.json"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
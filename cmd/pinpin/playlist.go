@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gawen/pinpin"
+)
+
+func runPlaylist(args []string) {
+	if len(args) == 0 || args[0] != "dump" {
+		fmt.Fprintf(os.Stderr, "usage: %s playlist dump [flags] <playlist.bin>\n", os.Args[0])
+		os.Exit(-1)
+	}
+
+	fs := flag.NewFlagSet("playlist dump", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s playlist dump [flags] <playlist.bin>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	asJson := fs.Bool("json", false, "print the tree as JSON")
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	buf, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read playlist: %s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	issues := pinpin.ValidatePlaylistBin(buf)
+	for _, issue := range issues {
+		fmt.Fprintf(os.Stderr, "⚠️ %s\n", issue.Error())
+	}
+
+	// dump what can be, the anomalies were reported above
+	dump := new(playlistDump)
+	for _, issue := range issues {
+		dump.Issues = append(dump.Issues, issue.Error())
+	}
+	if err := dump.build(decodePlaylistDumpItems(buf)); err != nil {
+		fmt.Fprintf(os.Stderr, "⚠️ unable to build the tree: %s\n", err.Error())
+		dump.Issues = append(dump.Issues, err.Error())
+	}
+
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(dump); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to print playlist: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if dump.Root != nil {
+		dump.Root.print(os.Stdout, 0)
+	}
+	if len(dump.Unreachable) > 0 {
+		fmt.Fprintf(os.Stdout, "unreachable from the root:\n")
+		for _, node := range dump.Unreachable {
+			node.print(os.Stdout, 1)
+		}
+	}
+}
+
+type playlistDump struct {
+	Root        *playlistDumpNode   `json:"root,omitempty"`
+	Unreachable []*playlistDumpNode `json:"unreachable,omitempty"`
+	Issues      []string            `json:"issues,omitempty"`
+}
+
+type playlistDumpNode struct {
+	ID            uint16              `json:"id"`
+	ParentID      uint16              `json:"parent_id"`
+	Order         uint16              `json:"order"`
+	Kind          string              `json:"kind"`
+	Discover      bool                `json:"discover,omitempty"`
+	FavoriteOrder uint16              `json:"favorite_order,omitempty"`
+	FileName      string              `json:"file_name"`
+	Title         string              `json:"title"`
+	AddTime       *time.Time          `json:"add_time,omitempty"`
+	LimitTime     *time.Time          `json:"limit_time,omitempty"`
+	Children      []*playlistDumpNode `json:"children,omitempty"`
+}
+
+// decodePlaylistDumpItems decodes the records of `buf`, keeping the malformed
+// ones with their strings cut to their field.
+func decodePlaylistDumpItems(buf []byte) []pinpin.PlaylistItem {
+	var items []pinpin.PlaylistItem
+	for item, err := range pinpin.NewPlaylistReader(bytes.NewReader(buf)).Items() {
+		if errors.Is(err, pinpin.ErrPlaylistTruncated) {
+			break
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// build dumps the tree of `items`, and the nodes out of it. If there is no
+// tree, the items are all dumped as unreachable.
+func (d *playlistDump) build(items []pinpin.PlaylistItem) error {
+	nodes, unreachable, err := pinpin.BuildPlaylistTreeWithUnreachable(items)
+	if err != nil {
+		for _, item := range items {
+			d.Unreachable = append(d.Unreachable, newPlaylistDumpNode(item))
+		}
+		return err
+	}
+
+	// the root found by BuildPlaylistTreeWithUnreachable
+	rootIdx := slices.IndexFunc(items, func(item pinpin.PlaylistItem) bool {
+		return item.Kind == pinpin.PlaylistItemKindRoot
+	})
+	d.Root = newPlaylistDumpNode(items[rootIdx])
+	d.Root.Children = newPlaylistDumpNodes(nodes)
+	d.Unreachable = newPlaylistDumpNodes(unreachable)
+	return nil
+}
+
+func newPlaylistDumpNodes(nodes []*pinpin.PlaylistTreeNode) (dumped []*playlistDumpNode) {
+	for _, node := range nodes {
+		dumpNode := newPlaylistDumpNode(*node.Item)
+		dumpNode.Children = newPlaylistDumpNodes(node.Children)
+		dumped = append(dumped, dumpNode)
+	}
+	return
+}
+
+func newPlaylistDumpNode(item pinpin.PlaylistItem) *playlistDumpNode {
+	node := &playlistDumpNode{
+		ID:            item.ID,
+		ParentID:      item.ParentID,
+		Order:         item.Order,
+		Kind:          playlistKindName(item.Kind),
+		Discover:      item.Kind&pinpin.PlaylistItemKindDiscoverMask != 0,
+		FavoriteOrder: item.FavoriteOrder,
+		FileName:      item.FileName,
+		Title:         item.Title,
+	}
+
+	if item.AddTimeUnix != 0 {
+		t := time.Unix(int64(item.AddTimeUnix), 0)
+		node.AddTime = &t
+	}
+	if item.LimitTimeUnix != 0 {
+		t := time.Unix(int64(item.LimitTimeUnix), 0)
+		node.LimitTime = &t
+	}
+
+	return node
+}
+
+func playlistKindName(kind pinpin.PlaylistItemKind) string {
+	switch kind &^ pinpin.PlaylistItemKindDiscoverMask {
+	case pinpin.PlaylistItemKindRoot:
+		return "root"
+	case pinpin.PlaylistItemKindFolder:
+		return "folder"
+	case pinpin.PlaylistItemKindFolderFavorite:
+		return "favorite folder"
+	case pinpin.PlaylistItemKindAudio:
+		return "audio"
+	default:
+		return fmt.Sprintf("unknown 0x%.4x", kind)
+	}
+}
+
+func (n *playlistDumpNode) print(w io.Writer, depth int) {
+	line := fmt.Sprintf("%s#%d %s '%s'", strings.Repeat("  ", depth), n.ID, n.Kind, n.Title)
+	if n.FileName != "" {
+		line += fmt.Sprintf(" file=%s", n.FileName)
+	}
+	if n.FavoriteOrder != 0 {
+		line += fmt.Sprintf(" favorite=#%d", n.FavoriteOrder)
+	}
+	if n.Discover {
+		line += " discover"
+	}
+	if n.AddTime != nil {
+		line += fmt.Sprintf(" added=%s", n.AddTime.Format(time.DateTime))
+	}
+	if n.LimitTime != nil {
+		line += fmt.Sprintf(" limit=%s", n.LimitTime.Format(time.DateTime))
+	}
+	fmt.Fprintln(w, line)
+
+	for _, child := range n.Children {
+		child.print(w, depth+1)
+	}
+}
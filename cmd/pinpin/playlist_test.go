@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/gawen/pinpin"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaylistDumpMalformed(t *testing.T) {
+	buf, err := pinpin.EncodePlaylistBin([]pinpin.PlaylistItem{
+		{ID: 1, Kind: pinpin.PlaylistItemKindRoot, ChildrenCount: 1},
+		{ID: 2, ParentID: 1, Kind: pinpin.PlaylistItemKindFolder, ChildrenCount: 1, FileName: "folder", Title: "Contes"},
+		{ID: 3, ParentID: 2, Kind: pinpin.PlaylistItemKindAudio, FileName: "story", Title: "Le loup"},
+		{ID: 4, ParentID: 42, Kind: pinpin.PlaylistItemKindAudio, FileName: "orphan", Title: "Orphelin"},
+	})
+	require.NoError(t, err)
+
+	// the folder's title length overflows its field, and a record is cut
+	buf[pinpin.PlaylistItemSize+85] = 0xff
+	buf = append(buf, 0x42)
+
+	items := decodePlaylistDumpItems(buf)
+	require.Len(t, items, 4)
+
+	dump := new(playlistDump)
+	require.NoError(t, dump.build(items))
+	require.Equal(t, uint16(1), dump.Root.ID)
+	require.Len(t, dump.Root.Children, 1)
+
+	folder := dump.Root.Children[0]
+	require.Equal(t, uint16(2), folder.ID)
+	require.Equal(t, "folder", folder.Kind)
+	require.Len(t, folder.Title, pinpin.PlaylistTitleMaxLen)
+	require.Len(t, folder.Children, 1)
+	require.Equal(t, "Le loup", folder.Children[0].Title)
+
+	require.Len(t, dump.Unreachable, 1)
+	require.Equal(t, uint16(4), dump.Unreachable[0].ID)
+	require.Equal(t, uint16(42), dump.Unreachable[0].ParentID)
+}
+
+func TestPlaylistDumpDuplicateIDs(t *testing.T) {
+	items := []pinpin.PlaylistItem{
+		{ID: 1, Kind: pinpin.PlaylistItemKindRoot, ChildrenCount: 1},
+		{ID: 2, ParentID: 1, Kind: pinpin.PlaylistItemKindAudio, FileName: "a"},
+		{ID: 2, ParentID: 1, Kind: pinpin.PlaylistItemKindAudio, FileName: "b"},
+	}
+
+	// without a tree, the items are still dumped
+	dump := new(playlistDump)
+	require.ErrorIs(t, dump.build(items), pinpin.ErrPlaylistDuplicateID)
+	require.Nil(t, dump.Root)
+	require.Len(t, dump.Unreachable, 3)
+}
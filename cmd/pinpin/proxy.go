@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gawen/pinpin"
+)
+
+func runProxy(args []string) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s proxy [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	listen := fs.String("listen", "127.0.0.1:50000", "address to listen on")
+	target := fs.String("target", "192.168.4.1:50000", "address of the Merlin")
+	tracePath := fs.String("trace", "", "also record the exchanges to this JSONL file")
+	fs.Parse(args)
+
+	p := &proxy{
+		target: *target,
+		out:    os.Stdout,
+	}
+
+	if *tracePath != "" {
+		traceFile, err := os.Create(*tracePath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to create trace file: %s\n", err.Error())
+			os.Exit(-1)
+		}
+		defer traceFile.Close()
+
+		p.trace = json.NewEncoder(traceFile)
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to listen: %s\n", err.Error())
+		os.Exit(-1)
+	}
+	defer l.Close()
+
+	fmt.Fprintf(os.Stderr, "🔀 proxying %s to %s\n", *listen, *target)
+	for connIdx := 1; ; connIdx++ {
+		client, err := l.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to accept: %s\n", err.Error())
+			os.Exit(-1)
+		}
+
+		go p.serve(connIdx, client)
+	}
+}
+
+type proxy struct {
+	target string
+
+	mu    sync.Mutex
+	out   io.Writer
+	trace *json.Encoder
+}
+
+func (p *proxy) serve(connIdx int, client net.Conn) {
+	defer client.Close()
+
+	p.logf(connIdx, "client %s connected", client.RemoteAddr())
+	device, err := net.DialTimeout("tcp", p.target, 5*time.Second)
+	if err != nil {
+		p.logf(connIdx, "unable to connect to the Merlin: %s", err.Error())
+		return
+	}
+	defer device.Close()
+
+	dissector := pinpin.NewDissector()
+	forward := func(dir pinpin.Direction, dst net.Conn, src net.Conn) error {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := src.Read(buf)
+			if n > 0 {
+				// dissected before being forwarded, so the dissector knows of
+				// a file transfer before its data comes, and the answer is
+				// printed after the command
+				p.mu.Lock()
+				segs := dissector.Feed(dir, buf[:n])
+				p.mu.Unlock()
+				p.print(connIdx, segs)
+
+				if _, err := dst.Write(buf[:n]); err != nil {
+					return err
+				}
+			}
+
+			if errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		err := forward(pinpin.DirectionToDevice, device, client)
+		device.Close()
+		done <- err
+	}()
+	go func() {
+		err := forward(pinpin.DirectionFromDevice, client, device)
+		client.Close()
+		done <- err
+	}()
+	for range 2 {
+		if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+			p.logf(connIdx, "%s", err.Error())
+		}
+	}
+
+	p.mu.Lock()
+	segs := dissector.Flush()
+	p.mu.Unlock()
+	p.print(connIdx, segs)
+	p.logf(connIdx, "closed")
+}
+
+func (p *proxy) logf(connIdx int, format string, args ...any) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	fmt.Fprintf(p.out, "#%d %s\n", connIdx, fmt.Sprintf(format, args...))
+}
+
+func (p *proxy) print(connIdx int, segs []pinpin.Segment) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, seg := range segs {
+		arrow := "→"
+		if seg.Direction == pinpin.DirectionFromDevice {
+			arrow = "←"
+		}
+
+		fmt.Fprintf(p.out, "#%d %s %s\n", connIdx, arrow, describeSegment(seg))
+		if p.trace != nil {
+			p.trace.Encode(pinpin.NewTraceRecord(now, seg))
+		}
+	}
+}
+
+// describeSegment decodes the fields of the known commands and flags the
+// unknown ones.
+func describeSegment(seg pinpin.Segment) string {
+	name, known := pinpin.CommandName(seg.Command)
+
+	if seg.Err != nil {
+		return fmt.Sprintf("%s: ⚠️ %s: %s", name, seg.Err.Error(), hex.EncodeToString(seg.Raw))
+	} else if !seg.Frame {
+		return fmt.Sprintf("%s: %dB of file data", name, len(seg.Raw))
+	} else if !known {
+		return fmt.Sprintf("⚠️ unknown command %s: %s", name, hex.EncodeToString(seg.Msg))
+	}
+
+	msg := seg.Msg
+	if seg.Direction == pinpin.DirectionToDevice {
+		switch seg.Command {
+		case pinpin.CommandUploadFile:
+			if len(msg) >= 2 && len(msg) == 2+int(msg[1])+4+sha256.Size {
+				nameLen := int(msg[1])
+				return fmt.Sprintf("%s path='%s' size=%dB sha256=%s", name,
+					msg[2:2+nameLen],
+					binary.LittleEndian.Uint32(msg[2+nameLen:]),
+					hex.EncodeToString(msg[2+nameLen+4:]),
+				)
+			}
+		case pinpin.CommandGetFileInformation:
+			if len(msg) == 4 {
+				return fmt.Sprintf("%s index=%d sha256=%t", name, binary.LittleEndian.Uint16(msg[1:3]), msg[3] != 0)
+			}
+		case pinpin.CommandGetFile, pinpin.CommandUpdatePlaylist:
+			return fmt.Sprintf("%s path='%s'", name, msg[1:])
+		default:
+			if len(msg) == 1 {
+				return name
+			}
+		}
+
+		return fmt.Sprintf("%s ⚠️ unexpected arguments: %s", name, hex.EncodeToString(msg))
+	}
+
+	switch seg.Command {
+	case pinpin.CommandGetSDSize:
+		if len(msg) >= 5 {
+			return fmt.Sprintf("%s size=%d", name, binary.LittleEndian.Uint32(msg[1:5]))
+		}
+	case pinpin.CommandGetNumberOfFiles:
+		if len(msg) >= 3 {
+			return fmt.Sprintf("%s count=%d", name, binary.LittleEndian.Uint16(msg[1:3]))
+		}
+	}
+
+	status, hasStatus := seg.Status()
+	if !hasStatus {
+		return fmt.Sprintf("%s ⚠️ unexpected answer: %s", name, hex.EncodeToString(msg))
+	}
+
+	desc := fmt.Sprintf("%s status=0x%.2x", name, status)
+	if status != pinpin.StatusOk && !(seg.Command == pinpin.CommandUploadFile && status == pinpin.StatusUploadShaValid) {
+		desc += fmt.Sprintf(" (%s)", (&pinpin.StatusError{Command: seg.Command, Code: status}).Error())
+	}
+
+	switch seg.Command {
+	case pinpin.CommandGetFileInformation:
+		if status == pinpin.StatusOk && len(msg) >= 3 && len(msg) >= 3+int(msg[2])+4+sha256.Size {
+			pathLen := int(msg[2])
+			desc += fmt.Sprintf(" path='%s' size=%dB sha256=%s",
+				msg[3:3+pathLen],
+				binary.LittleEndian.Uint32(msg[3+pathLen:]),
+				hex.EncodeToString(msg[3+pathLen+4:3+pathLen+4+sha256.Size]),
+			)
+		}
+	case pinpin.CommandGetFile:
+		if status == pinpin.StatusOk && len(msg) >= 3 && len(msg) >= 3+int(msg[2])+4 {
+			pathLen := int(msg[2])
+			desc += fmt.Sprintf(" path='%s' size=%dB", msg[3:3+pathLen], binary.LittleEndian.Uint32(msg[3+pathLen:]))
+		}
+	}
+
+	if extra := len(msg) - 2; extra > 0 && seg.Command != pinpin.CommandGetFileInformation && seg.Command != pinpin.CommandGetFile {
+		desc += fmt.Sprintf(" ⚠️ unexpected data: %s", hex.EncodeToString(msg[2:]))
+	}
+
+	return desc
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy(t *testing.T) {
+	_, address := simtest.Serve(t)
+
+	var out, trace bytes.Buffer
+	p := &proxy{
+		target: address,
+		out:    &out,
+		trace:  json.NewEncoder(&trace),
+	}
+
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer proxyListener.Close()
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		client, err := proxyListener.Accept()
+		if err == nil {
+			p.serve(1, client)
+		}
+	}()
+
+	c, err := pinpin.DialTimeout(proxyListener.Addr().String(), time.Second)
+	require.NoError(t, err)
+
+	// a few back-and-forths, for the file data to follow the answers
+	data := bytes.Repeat([]byte("pinpin"), 1000)
+	for range 3 {
+		require.NoError(t, c.UploadBytes("story.mp3", data))
+
+		var buf bytes.Buffer
+		require.NoError(t, c.GetFile("story.mp3", &buf))
+		require.Equal(t, data, buf.Bytes())
+	}
+	require.NoError(t, c.Ping())
+	require.NoError(t, c.Close())
+	<-served
+
+	require.NotContains(t, out.String(), "⚠️")
+	require.Contains(t, out.String(), "#1 → upload_file path='story.mp3' size=6000B")
+	require.Contains(t, out.String(), "#1 ← get_file status=0x00 path='story.mp3' size=6000B")
+	require.Equal(t, 3, strings.Count(out.String(), "← upload_file status=0x01"))
+	require.True(t, strings.HasSuffix(out.String(), "#1 closed\n"))
+
+	records, err := pinpin.ReadTrace(&trace)
+	require.NoError(t, err)
+	for _, rec := range records {
+		require.Empty(t, rec.Error)
+	}
+}
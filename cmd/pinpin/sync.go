@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/gawen/pinpin"
+	"github.com/google/uuid"
+	"github.com/schollz/progressbar/v3"
+)
+
+func runSync(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s sync [flags] <path to library to upload>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	cflags := mustAddConnFlags(fs)
+	diffJson := fs.Bool("diff-json", false, "print the changes to the playlist as JSON on stdout")
+	dryRun := fs.Bool("dry-run", false, "only print what would be uploaded and changed")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(-1)
+	}
+
+	lib := mustReadLibrary(fs.Arg(0))
+	cflags.setDefaultAddress(fs, lib.config.Address)
+	session, closer := mustConnectSync(ctx, cflags)
+	defer closer.Close()
+
+	plan, err := planSync(ctx, session, lib)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+	printPlaylistDiff(plan.Diff, *diffJson)
+
+	if *dryRun {
+		if err := printSyncDryRun(ctx, session, plan, os.Stderr); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(-1)
+		}
+		return
+	}
+
+	if err := applySync(ctx, session, plan); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	fmt.Fprintf(os.Stderr, "✅ transfered!\n")
+}
+
+type library struct {
+	path      string
+	cachePath string
+	config    *libraryConfig
+	nodes     []*pinpin.PlaylistTreeNode
+}
+
+func mustReadLibrary(libraryPath string) *library {
+	lib := &library{
+		path:      libraryPath,
+		cachePath: filepath.Join(libraryPath, ".cache"),
+	}
+
+	_ = os.Mkdir(lib.cachePath, 0755)
+	var err error
+	lib.nodes, lib.config, err = readLibrary(lib.path, lib.cachePath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to read library to upload: %s\n", err.Error())
+		os.Exit(-1)
+	}
+
+	fmt.Fprintf(os.Stderr, "🎧 Library read!\n")
+	for firstIdx, firstNode := range lib.nodes {
+		fmt.Fprintf(os.Stderr, "%d. %s\n", firstIdx+1, firstNode.Title)
+		for secondIdx, secondNode := range firstNode.Children {
+			fmt.Fprintf(os.Stderr, "  %d. %s\n", secondIdx+1, secondNode.Title)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\n")
+
+	return lib
+}
+
+func mustConnectSync(ctx context.Context, cflags *connFlags) (*pinpin.Session, io.Closer) {
+	fmt.Fprintf(os.Stderr, "🛜 connecting to the Merlin...\n")
+	fmt.Fprintf(os.Stderr, "ℹ️ set your Merlin in mode 'TRANSFERT', search for a Wi-Fi network named 'MERLIN_' and connect to it with password 'MERLIN_APP'.\n")
+	session, closer := mustConnect(ctx, cflags, pinpin.WithProgressReporter(pinpin.NewProgressBarReporter()))
+	fmt.Fprintf(os.Stderr, "🛜 connected ✅\n")
+
+	return session, closer
+}
+
+// syncPlan is what a sync does to the Merlin, and what it assumes of its
+// state. It is saved by `pinpin plan` to be run later by `pinpin apply`.
+type syncPlan struct {
+	Version int    `json:"version"`
+	Library string `json:"library"`
+	// Address is the Merlin's, from the library configuration.
+	Address string `json:"address,omitempty"`
+	// Uploads are the files of the library missing from the Merlin.
+	Uploads []plannedUpload `json:"uploads"`
+	// Existing are the files of the library the Merlin already has.
+	Existing []plannedExisting `json:"existing"`
+	// PlaylistBinSha256 is the hash of the `playlist.bin` the new playlist
+	// is based on.
+	PlaylistBinSha256 string                     `json:"playlist_bin_sha256"`
+	Playlist          []*pinpin.PlaylistTreeNode `json:"playlist"`
+	Diff              pinpin.PlaylistDiff        `json:"diff"`
+	// UsedSize is the total size of the files on the Merlin, but those the
+	// uploads overwrite.
+	UsedSize int64 `json:"used_size"`
+}
+
+const syncPlanVersion = 2
+
+type plannedFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type plannedExisting struct {
+	plannedFile
+	// Sha256 is the hash computed by the Merlin of the covers compared by
+	// hash, empty for the files compared by size.
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type plannedUpload struct {
+	plannedFile
+	LocalPath string `json:"local_path"`
+	Sha256    string `json:"sha256"`
+}
+
+// planSync compares the library to the files and the playlist of the Merlin.
+func planSync(ctx context.Context, session *pinpin.Session, lib *library) (*syncPlan, error) {
+	libraryPath, err := filepath.Abs(lib.path)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &syncPlan{
+		Version: syncPlanVersion,
+		Library: libraryPath,
+		Address: lib.config.Address,
+	}
+
+	// list already existing files
+	existingFileSize, err := listDeviceFiles(ctx, session)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list files in Merlin: %w", err)
+	}
+	for _, size := range existingFileSize {
+		plan.UsedSize += int64(size)
+	}
+
+	// list missing files, transfered once the new playlist is checked. The
+	// image of a folder changes with its cover, unlike its UUID
+	var transferFiles []string
+	coverFiles := make(map[string]bool)
+	for _, firstNode := range lib.nodes {
+		transferFiles = append(transferFiles,
+			firstNode.UUID+".jpg",
+		)
+		coverFiles[firstNode.UUID+".jpg"] = true
+		for _, secondNode := range firstNode.Children {
+			transferFiles = append(transferFiles,
+				secondNode.UUID+".mp3",
+				secondNode.UUID+".jpg",
+			)
+		}
+	}
+
+	for _, remoteFilePath := range transferFiles {
+		localFilePath := filepath.Join(libraryPath, ".cache", remoteFilePath)
+		fi, err := os.Stat(localFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		file := plannedFile{remoteFilePath, fi.Size()}
+		size, has := existingFileSize[remoteFilePath]
+		sameSize := has && size == uint32(fi.Size())
+		if sameSize && !coverFiles[remoteFilePath] {
+			plan.Existing = append(plan.Existing, plannedExisting{file, ""})
+			continue
+		}
+
+		checksum, err := hashLocalFile(localFilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		// another cover may have the same size
+		if sameSize {
+			deviceChecksum, err := getDeviceFileSha256(ctx, session, remoteFilePath)
+			if err != nil {
+				return nil, err
+			} else if deviceChecksum == checksum {
+				plan.Existing = append(plan.Existing, plannedExisting{file, checksum})
+				continue
+			}
+		}
+
+		plan.Uploads = append(plan.Uploads, plannedUpload{file, localFilePath, checksum})
+
+		// the upload overwrites the file on the Merlin
+		if size, has := existingFileSize[remoteFilePath]; has {
+			plan.UsedSize -= int64(size)
+		}
+	}
+
+	// get playlist
+	playlistBin, err := getDevicePlaylistBin(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	plan.PlaylistBinSha256 = hashBytes(playlistBin)
+
+	for _, issue := range pinpin.ValidatePlaylistBin(playlistBin) {
+		fmt.Fprintf(os.Stderr, "⚠️ 'playlist.bin': %s\n", issue.Error())
+	}
+
+	playlistItems, err := pinpin.DecodePlaylistBin(playlistBin)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode 'playlist.bin': %w", err)
+	}
+
+	oldTree, err := pinpin.BuildPlaylistTree(playlistItems)
+	if err != nil {
+		return nil, fmt.Errorf("unable to process `playlist.bin`: %w", err)
+	}
+
+	// replace old pinpin nodes new ones
+	var newTree []*pinpin.PlaylistTreeNode
+	for _, node := range oldTree {
+		u, err := uuid.Parse(node.UUID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "unable to parse UUID '%s'. ignore\n", node.UUID)
+			newTree = append(newTree, node)
+			continue
+		}
+
+		// remove node if it is from pinpin
+		if !isPinpinUUID(u) {
+			newTree = append(newTree, node)
+		}
+	}
+
+	newTree = append(newTree, lib.nodes...)
+
+	newItems, err := pinpin.FlattenPlaylistTree(newTree)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate `playlist.json`: %w", err)
+	}
+
+	var fatal bool
+	for _, issue := range pinpin.ValidatePlaylist(newItems) {
+		fmt.Fprintf(os.Stderr, "⚠️ new playlist: %s\n", issue.Error())
+		fatal = fatal || issue.Fatal()
+	}
+	if fatal {
+		return nil, fmt.Errorf("refusing to upload a playlist the Merlin would reject")
+	}
+
+	plan.Playlist = newTree
+	plan.Diff = pinpin.DiffPlaylistTrees(oldTree, newTree)
+	return plan, nil
+}
+
+// applySync uploads the missing files and the new playlist.
+func applySync(ctx context.Context, session *pinpin.Session, plan *syncPlan) error {
+	for _, upload := range plan.Uploads {
+		if err := session.UploadLocaFile(ctx, upload.Path, upload.LocalPath); err != nil {
+			return fmt.Errorf("unable to transfer file '%s': %w", upload.Path, err)
+		}
+	}
+
+	playlistJsonRaw, err := pinpin.MarshalPlaylistJson(plan.Playlist)
+	if err != nil {
+		return fmt.Errorf("unable to generate `playlist.json`: %w", err)
+	}
+
+	if err := session.UploadReadSeeker(ctx, "playlist.json", bytes.NewReader(playlistJsonRaw)); err != nil {
+		return fmt.Errorf("unable to upload `playlist.json`: %w", err)
+	}
+
+	if err := session.Do(ctx, func(ctx context.Context, conn *pinpin.Conn) error {
+		return conn.UpdatePlaylistContext(ctx, "playlist.json")
+	}); err != nil {
+		return fmt.Errorf("unable to apply `playlist.json`: %w", err)
+	}
+
+	if err := session.Do(ctx, func(ctx context.Context, conn *pinpin.Conn) error {
+		return conn.EndSynchronizationContext(ctx)
+	}); err != nil {
+		return fmt.Errorf("unable to end synchronization: %w", err)
+	}
+
+	return nil
+}
+
+func listDeviceFiles(ctx context.Context, session *pinpin.Session) (map[string]uint32, error) {
+	existingFileSize := make(map[string]uint32)
+	err := session.Do(ctx, func(ctx context.Context, conn *pinpin.Conn) error {
+		fileCount, err := conn.GetNumberOfFilesContext(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to get file count: %w", err)
+		}
+
+		listProg := progressbar.Default(int64(fileCount), "listing files...")
+		defer listProg.Close()
+		for idx := range fileCount {
+			fi, err := conn.GetFileInformationContext(ctx, idx, false)
+			if err != nil {
+				return fmt.Errorf("unable to get file #%d's information: %w", idx, err)
+			}
+
+			existingFileSize[fi.Path] = fi.Size
+			listProg.Add(1)
+		}
+
+		return nil
+	})
+	return existingFileSize, err
+}
+
+// getDeviceFileSha256 returns the hash of the file at `path`, computed by the
+// Merlin.
+func getDeviceFileSha256(ctx context.Context, session *pinpin.Session, path string) (string, error) {
+	var checksum string
+	if err := session.Do(ctx, func(ctx context.Context, conn *pinpin.Conn) error {
+		fi, err := conn.LookupFileInformationContext(ctx, path, true)
+		if err != nil {
+			return err
+		}
+		checksum = hex.EncodeToString(fi.Sha256)
+		return nil
+	}); err != nil {
+		return "", fmt.Errorf("unable to hash '%s' in Merlin: %w", path, err)
+	}
+	return checksum, nil
+}
+
+func getDevicePlaylistBin(ctx context.Context, session *pinpin.Session) ([]byte, error) {
+	var playlistBin bytes.Buffer
+	if err := session.Do(ctx, func(ctx context.Context, conn *pinpin.Conn) error {
+		playlistBin.Reset()
+		return conn.GetFileContext(ctx, "playlist.bin", &playlistBin)
+	}); err != nil {
+		return nil, fmt.Errorf("unable to get 'playlist.bin': %w", err)
+	}
+	return playlistBin.Bytes(), nil
+}
+
+func hashBytes(b []byte) string {
+	checksum := sha256.Sum256(b)
+	return hex.EncodeToString(checksum[:])
+}
+
+func hashLocalFile(path string) (string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, fh); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func printPlaylistDiff(diff pinpin.PlaylistDiff, asJson bool) {
+	if asJson {
+		if err := json.NewEncoder(os.Stdout).Encode(diff); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to print changes: %s\n", err.Error())
+			os.Exit(-1)
+		}
+	} else if len(diff) == 0 {
+		fmt.Fprintf(os.Stderr, "📝 no change to the playlist\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "📝 changes to the playlist:\n%s", diff.String())
+	}
+}
+
+// printSyncDryRun prints the files a sync would upload and whether they fit
+// on the SD card.
+// printSyncDryRun writes to `w` the files `plan` uploads, and whether they fit
+// on the SD card. Nothing is changed on the Merlin.
+func printSyncDryRun(ctx context.Context, session *pinpin.Session, plan *syncPlan, w io.Writer) error {
+	var sdSize uint32
+	if err := session.Do(ctx, func(ctx context.Context, conn *pinpin.Conn) (err error) {
+		sdSize, err = conn.GetSDSizeContext(ctx)
+		return
+	}); err != nil {
+		return fmt.Errorf("unable to get SD size: %w", err)
+	}
+
+	var uploadSize int64
+	fmt.Fprintf(w, "📦 %d files to upload:\n", len(plan.Uploads))
+	for _, upload := range plan.Uploads {
+		fmt.Fprintf(w, "  %s (%dB)\n", upload.Path, upload.Size)
+		uploadSize += upload.Size
+	}
+
+	fmt.Fprintf(w, "💾 %dB to upload, %dB used of %dB\n", uploadSize, plan.UsedSize, sdSize)
+	if plan.UsedSize+uploadSize > int64(sdSize) {
+		fmt.Fprintf(w, "⚠️ not enough space on the SD card\n")
+	}
+
+	fmt.Fprintf(w, "🔍 dry run: nothing was uploaded\n")
+	return nil
+}
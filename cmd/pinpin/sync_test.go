@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+// newSyncTest serves an empty Merlin and a library of one folder holding one
+// story, whose cached files are returned by their remote path.
+func newSyncTest(t *testing.T, opts ...pinpin.Option) (*pinpin.Session, *library, map[string][]byte) {
+	t.Helper()
+
+	_, address := simtest.Serve(t)
+	session := pinpin.NewSession(address, pinpin.RetryPolicy{Attempts: 1, DialTimeout: time.Second}, opts...)
+	t.Cleanup(func() { session.Close() })
+
+	playlistBin, err := pinpin.EncodePlaylistBin([]pinpin.PlaylistItem{{ID: 1, Kind: pinpin.PlaylistItemKindRoot}})
+	require.NoError(t, err)
+	require.NoError(t, session.UploadReadSeeker(context.Background(), "playlist.bin", bytes.NewReader(playlistBin)))
+
+	lib := &library{
+		path:   t.TempDir(),
+		config: &libraryConfig{},
+		nodes: []*pinpin.PlaylistTreeNode{{
+			UUID:  "0b1b5f3e-0000-4000-8000-000000000001",
+			Title: "Contes",
+			Children: []*pinpin.PlaylistTreeNode{{
+				UUID:  "0b1b5f3e-0000-4000-8000-000000000002",
+				Title: "Le loup",
+			}},
+		}},
+	}
+	lib.cachePath = filepath.Join(lib.path, ".cache")
+	require.NoError(t, os.Mkdir(lib.cachePath, 0o755))
+
+	files := map[string][]byte{
+		"0b1b5f3e-0000-4000-8000-000000000001.jpg": []byte("folder cover"),
+		"0b1b5f3e-0000-4000-8000-000000000002.jpg": []byte("story cover"),
+		"0b1b5f3e-0000-4000-8000-000000000002.mp3": bytes.Repeat([]byte("mp3"), 1000),
+	}
+	for path, data := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(lib.cachePath, path), data, 0o644))
+	}
+	return session, lib, files
+}
+
+func TestPlanSyncUsedSize(t *testing.T) {
+	session, lib, files := newSyncTest(t)
+	ctx := context.Background()
+
+	// an outdated mp3 the sync overwrites, and a file it keeps
+	storyPath := "0b1b5f3e-0000-4000-8000-000000000002.mp3"
+	require.NoError(t, session.UploadReadSeeker(ctx, storyPath, bytes.NewReader([]byte("old"))))
+	require.NoError(t, session.UploadReadSeeker(ctx, "other.mp3", bytes.NewReader([]byte("other"))))
+
+	plan, err := planSync(ctx, session, lib)
+	require.NoError(t, err)
+	require.Len(t, plan.Uploads, len(files))
+	require.Empty(t, plan.Existing)
+
+	// playlist.bin and the kept file
+	playlistBin, err := getDevicePlaylistBin(ctx, session)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(playlistBin)+len("other")), plan.UsedSize)
+}
+
+func TestPlanSyncCovers(t *testing.T) {
+	session, lib, files := newSyncTest(t)
+	ctx := context.Background()
+
+	for path, data := range files {
+		require.NoError(t, session.UploadReadSeeker(ctx, path, bytes.NewReader(data)))
+	}
+	plan, err := planSync(ctx, session, lib)
+	require.NoError(t, err)
+	require.Empty(t, plan.Uploads)
+	require.Len(t, plan.Existing, len(files))
+
+	// another cover of the same size
+	coverPath := "0b1b5f3e-0000-4000-8000-000000000001.jpg"
+	require.NoError(t, os.WriteFile(filepath.Join(lib.cachePath, coverPath), []byte("other  cover"), 0o644))
+
+	plan, err = planSync(ctx, session, lib)
+	require.NoError(t, err)
+	require.Len(t, plan.Uploads, 1)
+	require.Equal(t, coverPath, plan.Uploads[0].Path)
+	require.Len(t, plan.Existing, len(files)-1)
+}
+
+func TestSyncDryRun(t *testing.T) {
+	var trace bytes.Buffer
+	session, lib, _ := newSyncTest(t, pinpin.WithTraceRecorder(&trace))
+	ctx := context.Background()
+
+	var before bytes.Buffer
+	require.NoError(t, listFiles(ctx, session, true, &before))
+	trace.Reset()
+
+	plan, err := planSync(ctx, session, lib)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	require.NoError(t, printSyncDryRun(ctx, session, plan, &out))
+	require.Equal(t, "📦 3 files to upload:\n"+
+		"  0b1b5f3e-0000-4000-8000-000000000001.jpg (12B)\n"+
+		"  0b1b5f3e-0000-4000-8000-000000000002.mp3 (3000B)\n"+
+		"  0b1b5f3e-0000-4000-8000-000000000002.jpg (11B)\n"+
+		"💾 3023B to upload, 152B used of 2147483648B\n"+
+		"🔍 dry run: nothing was uploaded\n", out.String())
+
+	// nothing was uploaded, nor the playlist changed: the files, playlist.bin
+	// included, keep their hash
+	var commands []string
+	dec := json.NewDecoder(&trace)
+	for dec.More() {
+		var rec pinpin.TraceRecord
+		require.NoError(t, dec.Decode(&rec))
+		if rec.Direction == pinpin.DirectionToDevice && rec.Frame {
+			commands = append(commands, rec.Command)
+		}
+	}
+	require.Contains(t, commands, "get_sd_size")
+	for _, command := range []string{"upload_file", "update_playlist", "end_synchronization"} {
+		require.NotContains(t, commands, command)
+	}
+
+	var after bytes.Buffer
+	require.NoError(t, listFiles(ctx, session, true, &after))
+	require.Equal(t, before.String(), after.String())
+}
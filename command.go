@@ -1,5 +1,7 @@
 package pinpin
 
+import "fmt"
+
 type Command = byte
 
 const (
@@ -12,3 +14,24 @@ const (
 	CommandGetFileInformation Command = 0x0c
 	CommandGetFile            Command = 0x0d
 )
+
+var commandNames = map[Command]string{
+	CommandUploadFile:         "upload_file",
+	CommandPing:               "ping",
+	CommandGetSDSize:          "get_sd_size",
+	CommandUpdatePlaylist:     "update_playlist",
+	CommandEndSynchronization: "end_synchronization",
+	CommandGetNumberOfFiles:   "get_number_of_files",
+	CommandGetFileInformation: "get_file_information",
+	CommandGetFile:            "get_file",
+}
+
+// CommandName returns the name of `cmd`, or its hexadecimal value and false
+// if it is unknown.
+func CommandName(cmd Command) (string, bool) {
+	if name, has := commandNames[cmd]; has {
+		return name, true
+	}
+
+	return fmt.Sprintf("0x%.2x", cmd), false
+}
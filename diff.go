@@ -0,0 +1,305 @@
+package pinpin
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type PlaylistChangeKind string
+
+const (
+	PlaylistChangeAdded     PlaylistChangeKind = "added"
+	PlaylistChangeRemoved   PlaylistChangeKind = "removed"
+	PlaylistChangeMoved     PlaylistChangeKind = "moved"
+	PlaylistChangeRetitled  PlaylistChangeKind = "retitled"
+	PlaylistChangeReordered PlaylistChangeKind = "reordered"
+	PlaylistChangeFavorite  PlaylistChangeKind = "favorite"
+	PlaylistChangeDiscover  PlaylistChangeKind = "discover"
+)
+
+// PlaylistChange is a change of a node between two playlist trees.
+type PlaylistChange struct {
+	Kind PlaylistChangeKind `json:"kind"`
+	UUID string             `json:"uuid"`
+	// Path is the path of the node in the new tree, or in the old one if it
+	// was removed.
+	Path string `json:"path"`
+	// From and To are the old and new values: the path of a moved node, the
+	// title of a retitled one, the position of a reordered one among its
+	// siblings present in both trees, and the flag of a favorite or discover
+	// change.
+	From PlaylistChangeValue `json:"from,omitzero"`
+	To   PlaylistChangeValue `json:"to,omitzero"`
+	// Descendants is the number of nodes added or removed along with the
+	// node. They are not listed. The nodes below it which exist in both trees
+	// are listed, e.g. as moved.
+	Descendants int `json:"descendants,omitempty"`
+}
+
+// PlaylistChangeValue is the old or new value of a change: a text for a path
+// or a title, a number for a position or a flag. It renders in JSON as a
+// string or a number, and is read back as such.
+type PlaylistChangeValue struct {
+	Text     string
+	Number   int
+	IsNumber bool
+}
+
+func playlistChangeText(text string) PlaylistChangeValue {
+	return PlaylistChangeValue{Text: text}
+}
+
+func playlistChangeNumber(number int) PlaylistChangeValue {
+	return PlaylistChangeValue{Number: number, IsNumber: true}
+}
+
+func (v PlaylistChangeValue) String() string {
+	if v.IsNumber {
+		return strconv.Itoa(v.Number)
+	}
+	return v.Text
+}
+
+func (v PlaylistChangeValue) MarshalJSON() ([]byte, error) {
+	if v.IsNumber {
+		return json.Marshal(v.Number)
+	}
+	return json.Marshal(v.Text)
+}
+
+func (v *PlaylistChangeValue) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*v = PlaylistChangeValue{}
+		return json.Unmarshal(b, &v.Text)
+	}
+
+	*v = PlaylistChangeValue{IsNumber: true}
+	if err := json.Unmarshal(b, &v.Number); err != nil {
+		return fmt.Errorf("change value %s: expected a string or an integer", b)
+	}
+	return nil
+}
+
+func (c PlaylistChange) String() string {
+	desc := fmt.Sprintf("%-9s %s", c.Kind, c.Path)
+	switch c.Kind {
+	case PlaylistChangeAdded, PlaylistChangeRemoved:
+		if c.Descendants > 0 {
+			desc += fmt.Sprintf(" (and %d nodes below)", c.Descendants)
+		}
+	case PlaylistChangeMoved:
+		desc += fmt.Sprintf(" (from %s)", c.From)
+	case PlaylistChangeRetitled:
+		desc += fmt.Sprintf(": '%s' → '%s'", c.From, c.To)
+	case PlaylistChangeReordered:
+		desc += fmt.Sprintf(": #%s → #%s", c.From, c.To)
+	default:
+		desc += fmt.Sprintf(": %s → %s", c.From, c.To)
+	}
+	return desc
+}
+
+// PlaylistDiff is the list of changes from a playlist tree to another. It
+// renders as JSON with `json.Marshal`.
+type PlaylistDiff []PlaylistChange
+
+func (d PlaylistDiff) String() string {
+	var b strings.Builder
+	for _, c := range d {
+		b.WriteString(c.String())
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+type playlistDiffEntry struct {
+	node       *PlaylistTreeNode
+	parentUUID string
+	index      int
+	path       string
+}
+
+func indexPlaylistTree(nodes []*PlaylistTreeNode) map[string]playlistDiffEntry {
+	entries := make(map[string]playlistDiffEntry)
+
+	var index func(nodes []*PlaylistTreeNode, parentUUID string, parentPath string)
+	index = func(nodes []*PlaylistTreeNode, parentUUID string, parentPath string) {
+		for idx, node := range nodes {
+			path := parentPath + "/" + node.Title
+			if _, has := entries[node.UUID]; !has {
+				entries[node.UUID] = playlistDiffEntry{node, parentUUID, idx, path}
+			}
+			index(node.Children, node.UUID, path)
+		}
+	}
+	index(nodes, "", "")
+
+	return entries
+}
+
+// countMissingPlaylistNodes counts the nodes of `nodes` missing from
+// `entries`, and their missing descendants.
+func countMissingPlaylistNodes(nodes []*PlaylistTreeNode, entries map[string]playlistDiffEntry) (n int) {
+	for _, node := range nodes {
+		if _, has := entries[node.UUID]; !has {
+			n += 1 + countMissingPlaylistNodes(node.Children, entries)
+		}
+	}
+	return
+}
+
+// DiffPlaylistTrees lists the changes from `oldTree` to `newTree`, matching
+// the nodes by UUID. The removed nodes come first, then the others in the
+// order of `newTree`.
+func DiffPlaylistTrees(oldTree []*PlaylistTreeNode, newTree []*PlaylistTreeNode) PlaylistDiff {
+	oldEntries := indexPlaylistTree(oldTree)
+	newEntries := indexPlaylistTree(newTree)
+
+	var diff PlaylistDiff
+
+	// only the topmost removed node of a subtree is listed
+	var removed func(nodes []*PlaylistTreeNode, parentRemoved bool)
+	removed = func(nodes []*PlaylistTreeNode, parentRemoved bool) {
+		for _, node := range nodes {
+			if _, has := newEntries[node.UUID]; has {
+				removed(node.Children, false)
+				continue
+			}
+
+			if !parentRemoved {
+				diff = append(diff, PlaylistChange{
+					Kind:        PlaylistChangeRemoved,
+					UUID:        node.UUID,
+					Path:        oldEntries[node.UUID].path,
+					Descendants: countMissingPlaylistNodes(node.Children, newEntries),
+				})
+			}
+			removed(node.Children, true)
+		}
+	}
+	removed(oldTree, false)
+
+	// likewise for the added nodes
+	var changed func(nodes []*PlaylistTreeNode, parentUUID string, parentAdded bool)
+	changed = func(nodes []*PlaylistTreeNode, parentUUID string, parentAdded bool) {
+		reordered := reorderedPlaylistNodes(oldEntries, nodes, parentUUID)
+
+		for _, node := range nodes {
+			newEntry := newEntries[node.UUID]
+			oldEntry, has := oldEntries[node.UUID]
+			if !has {
+				if !parentAdded {
+					diff = append(diff, PlaylistChange{
+						Kind:        PlaylistChangeAdded,
+						UUID:        node.UUID,
+						Path:        newEntry.path,
+						Descendants: countMissingPlaylistNodes(node.Children, oldEntries),
+					})
+				}
+				changed(node.Children, node.UUID, true)
+				continue
+			}
+
+			change := func(kind PlaylistChangeKind, from PlaylistChangeValue, to PlaylistChangeValue) {
+				diff = append(diff, PlaylistChange{
+					Kind: kind,
+					UUID: node.UUID,
+					Path: newEntry.path,
+					From: from,
+					To:   to,
+				})
+			}
+
+			if oldEntry.parentUUID != parentUUID {
+				change(PlaylistChangeMoved, playlistChangeText(oldEntry.path), playlistChangeText(newEntry.path))
+			} else if r, has := reordered[node.UUID]; has {
+				change(PlaylistChangeReordered, playlistChangeNumber(r.from), playlistChangeNumber(r.to))
+			}
+
+			if oldEntry.node.Title != node.Title {
+				change(PlaylistChangeRetitled, playlistChangeText(oldEntry.node.Title), playlistChangeText(node.Title))
+			}
+			if oldEntry.node.Favorite != node.Favorite {
+				change(PlaylistChangeFavorite, playlistChangeNumber(int(oldEntry.node.Favorite)), playlistChangeNumber(int(node.Favorite)))
+			}
+			if oldEntry.node.Discover != node.Discover {
+				change(PlaylistChangeDiscover, playlistChangeNumber(int(oldEntry.node.Discover)), playlistChangeNumber(int(node.Discover)))
+			}
+
+			changed(node.Children, node.UUID, false)
+		}
+	}
+	changed(newTree, "", false)
+
+	return diff
+}
+
+// playlistReorder is the old and new positions of a node among its siblings
+// present in both trees.
+type playlistReorder struct {
+	from, to int
+}
+
+// reorderedPlaylistNodes returns the nodes of `nodes` which were already
+// children of `parentUUID` but changed of relative order. The nodes kept in
+// order are the longest common subsequence of the old and new orders, so
+// inserting or removing a node does not reorder its siblings.
+func reorderedPlaylistNodes(oldEntries map[string]playlistDiffEntry, nodes []*PlaylistTreeNode, parentUUID string) map[string]playlistReorder {
+	var newOrder []string
+	for _, node := range nodes {
+		if entry, has := oldEntries[node.UUID]; has && entry.parentUUID == parentUUID {
+			newOrder = append(newOrder, node.UUID)
+		}
+	}
+	if len(newOrder) < 2 {
+		return nil
+	}
+
+	oldOrder := slices.Clone(newOrder)
+	slices.SortFunc(oldOrder, func(a, b string) int {
+		return cmp.Compare(oldEntries[a].index, oldEntries[b].index)
+	})
+
+	// lcs[i][j] is the length of the LCS of oldOrder[i:] and newOrder[j:]
+	n := len(newOrder)
+	lcs := make([][]int, n+1)
+	for i := range lcs {
+		lcs[i] = make([]int, n+1)
+	}
+	for i := n - 1; i >= 0; i-- {
+		for j := n - 1; j >= 0; j-- {
+			if oldOrder[i] == newOrder[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	reordered := make(map[string]playlistReorder, n)
+	for to, uuid := range newOrder {
+		reordered[uuid] = playlistReorder{to: to}
+	}
+	for from, uuid := range oldOrder {
+		r := reordered[uuid]
+		r.from = from
+		reordered[uuid] = r
+	}
+	for i, j := 0, 0; i < n && j < n; {
+		if oldOrder[i] == newOrder[j] {
+			delete(reordered, oldOrder[i])
+			i++
+			j++
+		} else if lcs[i+1][j] >= lcs[i][j+1] {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	return reordered
+}
@@ -0,0 +1,113 @@
+package pinpin
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func diffTestNode(uuid string, children ...*PlaylistTreeNode) *PlaylistTreeNode {
+	return &PlaylistTreeNode{UUID: uuid, Title: uuid, Children: children}
+}
+
+func TestDiffPlaylistTreesMoveIntoAddedFolder(t *testing.T) {
+	oldTree := []*PlaylistTreeNode{
+		diffTestNode("A", diffTestNode("a1"), diffTestNode("a2")),
+	}
+	newTree := []*PlaylistTreeNode{
+		diffTestNode("B", diffTestNode("a1"), diffTestNode("b1")),
+	}
+
+	require.Equal(t, PlaylistDiff{
+		{Kind: PlaylistChangeRemoved, UUID: "A", Path: "/A", Descendants: 1},
+		{Kind: PlaylistChangeAdded, UUID: "B", Path: "/B", Descendants: 1},
+		{Kind: PlaylistChangeMoved, UUID: "a1", Path: "/B/a1", From: playlistChangeText("/A/a1"), To: playlistChangeText("/B/a1")},
+	}, DiffPlaylistTrees(oldTree, newTree))
+}
+
+func TestDiffPlaylistTreesNestedChanges(t *testing.T) {
+	oldTree := []*PlaylistTreeNode{
+		diffTestNode("A", diffTestNode("B", diffTestNode("c1"), diffTestNode("c2"))),
+		diffTestNode("D", diffTestNode("d1"), diffTestNode("d2"), diffTestNode("d3")),
+	}
+	newTree := []*PlaylistTreeNode{
+		// B is moved out of the removed A, and loses c2
+		diffTestNode("B", diffTestNode("c1")),
+		// E is added with a new child below the moved d1
+		diffTestNode("E", diffTestNode("e1"), diffTestNode("d1", diffTestNode("f1"))),
+		diffTestNode("D", diffTestNode("d3"), diffTestNode("d2")),
+	}
+	newTree[2].Title = "Dee"
+
+	require.Equal(t, PlaylistDiff{
+		{Kind: PlaylistChangeRemoved, UUID: "A", Path: "/A"},
+		{Kind: PlaylistChangeRemoved, UUID: "c2", Path: "/A/B/c2"},
+		{Kind: PlaylistChangeMoved, UUID: "B", Path: "/B", From: playlistChangeText("/A/B"), To: playlistChangeText("/B")},
+		{Kind: PlaylistChangeAdded, UUID: "E", Path: "/E", Descendants: 1},
+		{Kind: PlaylistChangeMoved, UUID: "d1", Path: "/E/d1", From: playlistChangeText("/D/d1"), To: playlistChangeText("/E/d1")},
+		{Kind: PlaylistChangeAdded, UUID: "f1", Path: "/E/d1/f1"},
+		{Kind: PlaylistChangeRetitled, UUID: "D", Path: "/Dee", From: playlistChangeText("D"), To: playlistChangeText("Dee")},
+		{Kind: PlaylistChangeReordered, UUID: "d2", Path: "/Dee/d2", From: playlistChangeNumber(0), To: playlistChangeNumber(1)},
+	}, DiffPlaylistTrees(oldTree, newTree))
+}
+
+func TestDiffPlaylistTreesReorderAfterRemoval(t *testing.T) {
+	oldTree := []*PlaylistTreeNode{
+		diffTestNode("D", diffTestNode("a"), diffTestNode("b"), diffTestNode("c")),
+	}
+	newTree := []*PlaylistTreeNode{
+		diffTestNode("D", diffTestNode("c"), diffTestNode("b")),
+	}
+
+	// the positions are among b and c, not counting the removed a
+	diff := DiffPlaylistTrees(oldTree, newTree)
+	require.Equal(t, PlaylistDiff{
+		{Kind: PlaylistChangeRemoved, UUID: "a", Path: "/D/a"},
+		{Kind: PlaylistChangeReordered, UUID: "b", Path: "/D/b", From: playlistChangeNumber(0), To: playlistChangeNumber(1)},
+	}, diff)
+	require.Equal(t, "reordered /D/b: #0 → #1\n", diff[1:].String())
+}
+
+func TestDiffPlaylistTreesSame(t *testing.T) {
+	tree := []*PlaylistTreeNode{diffTestNode("A", diffTestNode("a1"))}
+	require.Empty(t, DiffPlaylistTrees(tree, tree))
+}
+
+func TestPlaylistDiffJson(t *testing.T) {
+	oldTree := []*PlaylistTreeNode{
+		diffTestNode("A", diffTestNode("a1"), diffTestNode("a2")),
+		diffTestNode("B", diffTestNode("b1")),
+	}
+	newTree := []*PlaylistTreeNode{
+		diffTestNode("A", diffTestNode("a2"), diffTestNode("a1"), diffTestNode("b1")),
+		diffTestNode("B"),
+	}
+	newTree[0].Title = "Aa"
+	newTree[0].Children[0].Favorite = 1
+	diff := DiffPlaylistTrees(oldTree, newTree)
+
+	raw, err := json.Marshal(diff)
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		{"kind": "retitled", "uuid": "A", "path": "/Aa", "from": "A", "to": "Aa"},
+		{"kind": "favorite", "uuid": "a2", "path": "/Aa/a2", "from": 0, "to": 1},
+		{"kind": "reordered", "uuid": "a1", "path": "/Aa/a1", "from": 0, "to": 1},
+		{"kind": "moved", "uuid": "b1", "path": "/Aa/b1", "from": "/B/b1", "to": "/Aa/b1"}
+	]`, string(raw))
+
+	// the values are read back with their type
+	var parsed PlaylistDiff
+	require.NoError(t, json.Unmarshal(raw, &parsed))
+	require.Equal(t, diff, parsed)
+	require.Equal(t, diff.String(), parsed.String())
+
+	// added and removed changes have no value
+	raw, err = json.Marshal(PlaylistChange{Kind: PlaylistChangeAdded, UUID: "c", Path: "/c"})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"kind": "added", "uuid": "c", "path": "/c"}`, string(raw))
+
+	var change PlaylistChange
+	require.ErrorContains(t, json.Unmarshal([]byte(`{"kind": "favorite", "from": true}`), &change), "expected a string or an integer")
+	require.ErrorContains(t, json.Unmarshal([]byte(`{"kind": "reordered", "from": 1.5}`), &change), "expected a string or an integer")
+}
@@ -0,0 +1,178 @@
+package pinpin
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+)
+
+type Direction int
+
+const (
+	// DirectionToDevice is the traffic sent by the client to the Merlin.
+	DirectionToDevice Direction = iota
+	// DirectionFromDevice is the traffic sent by the Merlin to the client.
+	DirectionFromDevice
+)
+
+func (d Direction) String() string {
+	if d == DirectionFromDevice {
+		return "recv"
+	}
+	return "send"
+}
+
+func (d Direction) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Direction) UnmarshalText(b []byte) error {
+	switch string(b) {
+	case "send":
+		*d = DirectionToDevice
+	case "recv":
+		*d = DirectionFromDevice
+	default:
+		return fmt.Errorf("unknown direction '%s'", b)
+	}
+	return nil
+}
+
+// Segment is a piece of the protocol stream: a frame, or raw file data sent
+// after an upload or get file command.
+type Segment struct {
+	Direction Direction
+	// Raw is the segment as sent on the wire.
+	Raw []byte
+	// Frame is false for raw file data.
+	Frame bool
+	// Msg is the message of a frame.
+	Msg []byte
+	// Err is set if the frame is corrupted or truncated.
+	Err error
+	// Command is the command the segment belongs to. Answers are attributed
+	// to the last command sent.
+	Command Command
+}
+
+// Status returns the status of an answer frame, if its command has one.
+func (s Segment) Status() (Status, bool) {
+	if !s.Frame || s.Err != nil || s.Direction != DirectionFromDevice || len(s.Msg) < 2 {
+		return 0, false
+	}
+
+	switch s.Command {
+	case CommandGetSDSize, CommandGetNumberOfFiles:
+		return 0, false
+	}
+
+	return s.Msg[1], true
+}
+
+// Dissector splits the two directions of a protocol stream into segments.
+// It follows the exchanges to know when raw file data is expected instead of
+// frames.
+type Dissector struct {
+	bufs       [2][]byte
+	dataLeft   [2]int64
+	command    Command
+	uploadSize uint32
+}
+
+func NewDissector() *Dissector {
+	return new(Dissector)
+}
+
+// Feed adds bytes seen in direction `dir` and returns the segments they
+// complete.
+func (d *Dissector) Feed(dir Direction, p []byte) (segs []Segment) {
+	d.bufs[dir] = append(d.bufs[dir], p...)
+
+	for len(d.bufs[dir]) > 0 {
+		buf := d.bufs[dir]
+
+		if left := d.dataLeft[dir]; left > 0 {
+			n := int(min(int64(len(buf)), left))
+			segs = append(segs, Segment{
+				Direction: dir,
+				Raw:       slices.Clone(buf[:n]),
+				Command:   d.command,
+			})
+			d.dataLeft[dir] -= int64(n)
+			d.bufs[dir] = buf[n:]
+			continue
+		}
+
+		frameLen := 1 + int(buf[0])
+		if len(buf) < frameLen {
+			break
+		}
+
+		seg := Segment{
+			Direction: dir,
+			Raw:       slices.Clone(buf[:frameLen]),
+			Frame:     true,
+		}
+		seg.Msg, seg.Err = DecodeFramePayload(seg.Raw[1:])
+		d.bufs[dir] = buf[frameLen:]
+
+		if seg.Err == nil {
+			d.follow(&seg)
+		} else {
+			seg.Command = d.command
+		}
+		segs = append(segs, seg)
+	}
+
+	return
+}
+
+// Flush returns the bytes left in both directions as truncated segments.
+func (d *Dissector) Flush() (segs []Segment) {
+	for _, dir := range []Direction{DirectionToDevice, DirectionFromDevice} {
+		if len(d.bufs[dir]) == 0 {
+			continue
+		}
+
+		segs = append(segs, Segment{
+			Direction: dir,
+			Raw:       d.bufs[dir],
+			Frame:     d.dataLeft[dir] == 0,
+			Err:       ErrFrameTruncated,
+			Command:   d.command,
+		})
+		d.bufs[dir] = nil
+	}
+	return
+}
+
+// follow updates the state of the exchange with a valid frame.
+func (d *Dissector) follow(seg *Segment) {
+	msg := seg.Msg
+	if seg.Direction == DirectionToDevice {
+		d.command = msg[0]
+		seg.Command = d.command
+
+		d.uploadSize = 0
+		if d.command == CommandUploadFile && len(msg) >= 2 && len(msg) >= 2+int(msg[1])+4 {
+			d.uploadSize = binary.LittleEndian.Uint32(msg[2+int(msg[1]):])
+		}
+		return
+	}
+
+	seg.Command = d.command
+	status, hasStatus := seg.Status()
+	if !hasStatus || status != StatusOk {
+		return
+	}
+
+	switch d.command {
+	case CommandUploadFile:
+		d.dataLeft[DirectionToDevice] = int64(d.uploadSize)
+		d.uploadSize = 0
+	case CommandGetFile:
+		if len(msg) >= 3 && len(msg) >= 3+int(msg[2])+4 {
+			d.dataLeft[DirectionFromDevice] = int64(binary.LittleEndian.Uint32(msg[3+int(msg[2]):]))
+		}
+	}
+}
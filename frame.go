@@ -0,0 +1,125 @@
+package pinpin
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A frame is a 1-byte length, followed by the message and the little-endian
+// `Crc32` of the message. The length counts the message and the CRC.
+
+const (
+	frameCrcSize = 4
+
+	// MaxFrameMessageSize is the largest message a frame can carry.
+	MaxFrameMessageSize = math.MaxUint8 - frameCrcSize
+)
+
+var (
+	ErrFrameEmpty     = errors.New("frame message is empty")
+	ErrFrameTooLarge  = errors.New("frame message is too large")
+	ErrFrameTruncated = errors.New("frame is truncated")
+	ErrFrameCorrupted = errors.New("frame is corrupted")
+)
+
+// AppendFrame appends the frame carrying `msg` to `dst`.
+func AppendFrame(dst []byte, msg []byte) ([]byte, error) {
+	if len(msg) == 0 {
+		return dst, ErrFrameEmpty
+	} else if len(msg) > MaxFrameMessageSize {
+		return dst, fmt.Errorf("%w: %dB, max %dB", ErrFrameTooLarge, len(msg), MaxFrameMessageSize)
+	}
+
+	dst = append(dst, byte(len(msg)+frameCrcSize))
+	dst = append(dst, msg...)
+	dst = binary.LittleEndian.AppendUint32(dst, Crc32(msg))
+	return dst, nil
+}
+
+type FrameEncoder struct {
+	w io.Writer
+}
+
+func NewFrameEncoder(w io.Writer) *FrameEncoder {
+	return &FrameEncoder{
+		w: w,
+	}
+}
+
+// Encode writes the frame carrying `msg` in a single write.
+func (e *FrameEncoder) Encode(msg []byte) error {
+	buf, err := AppendFrame(make([]byte, 0, 1+len(msg)+frameCrcSize), msg)
+	if err != nil {
+		return err
+	}
+
+	if sz, err := e.w.Write(buf); err != nil {
+		return fmt.Errorf("unable to write: %w", err)
+	} else if sz != len(buf) {
+		return fmt.Errorf("unable to write %dB: %w", len(buf), io.ErrShortWrite)
+	}
+
+	return nil
+}
+
+// FrameDecoder reads frames from a stream. It never reads past the end of a
+// frame, so the stream may carry raw data between frames.
+type FrameDecoder struct {
+	r io.Reader
+}
+
+func NewFrameDecoder(r io.Reader) *FrameDecoder {
+	return &FrameDecoder{
+		r: r,
+	}
+}
+
+// Decode reads the next frame and returns its message. It returns `io.EOF`
+// if the stream ends before a new frame.
+func (d *FrameDecoder) Decode() ([]byte, error) {
+	// read length of message
+	hdr := make([]byte, 1)
+	if _, err := io.ReadFull(d.r, hdr); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("unable to read length header: %w", err)
+	}
+
+	payloadLen := int(hdr[0])
+	if payloadLen <= frameCrcSize {
+		return nil, fmt.Errorf("%w: invalid length %dB", ErrFrameCorrupted, payloadLen)
+	}
+
+	// read message + crc
+	payload := make([]byte, payloadLen)
+	if _, err := io.ReadFull(d.r, payload); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		// not `io.EOF`, which would pass for the end of the stream
+		return nil, fmt.Errorf("%w: unable to read payload of %dB: %w", ErrFrameTruncated, payloadLen, io.ErrUnexpectedEOF)
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read payload of %dB: %w", payloadLen, err)
+	}
+
+	return DecodeFramePayload(payload)
+}
+
+// DecodeFramePayload checks the CRC of a frame's payload, i.e. the frame
+// without its length header, and returns its message.
+func DecodeFramePayload(payload []byte) ([]byte, error) {
+	if len(payload) <= frameCrcSize {
+		return nil, fmt.Errorf("%w: payload of %dB", ErrFrameTruncated, len(payload))
+	}
+
+	msg := payload[:len(payload)-frameCrcSize]
+	gotDigest := binary.LittleEndian.Uint32(payload[len(msg):])
+
+	// check crc
+	if expectedDigest := Crc32(msg); expectedDigest != gotDigest {
+		return nil, fmt.Errorf("%w: wrong crc32: expected %.8x, got %.8x", ErrFrameCorrupted, expectedDigest, gotDigest)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,111 @@
+package pinpin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewFrameEncoder(&buf)
+	msgs := [][]byte{{CommandPing}, []byte("pinpin"), bytes.Repeat([]byte{0xff}, MaxFrameMessageSize)}
+	for _, msg := range msgs {
+		require.NoError(t, enc.Encode(msg))
+	}
+
+	dec := NewFrameDecoder(&buf)
+	for _, msg := range msgs {
+		got, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+	}
+
+	_, err := dec.Decode()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestFrameErrors(t *testing.T) {
+	_, err := AppendFrame(nil, nil)
+	require.ErrorIs(t, err, ErrFrameEmpty)
+
+	_, err = AppendFrame(nil, make([]byte, MaxFrameMessageSize+1))
+	require.ErrorIs(t, err, ErrFrameTooLarge)
+
+	frame, err := AppendFrame(nil, []byte("pinpin"))
+	require.NoError(t, err)
+
+	// cut in the payload
+	_, err = NewFrameDecoder(bytes.NewReader(frame[:len(frame)-1])).Decode()
+	require.ErrorIs(t, err, ErrFrameTruncated)
+
+	// wrong CRC
+	corrupted := bytes.Clone(frame)
+	corrupted[1] ^= 0xff
+	_, err = NewFrameDecoder(bytes.NewReader(corrupted)).Decode()
+	require.ErrorIs(t, err, ErrFrameCorrupted)
+
+	// length shorter than the CRC
+	_, err = NewFrameDecoder(bytes.NewReader([]byte{frameCrcSize, 0, 0, 0, 0})).Decode()
+	require.ErrorIs(t, err, ErrFrameCorrupted)
+
+	_, err = DecodeFramePayload(frame[1:frameCrcSize])
+	require.ErrorIs(t, err, ErrFrameTruncated)
+}
+
+func FuzzFrameDecoder(f *testing.F) {
+	frame, _ := AppendFrame(nil, []byte{CommandPing})
+	f.Add(frame)
+	f.Add(append(frame, frame...))
+	f.Add([]byte{0xff, 0x00})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		dec := NewFrameDecoder(r)
+		for {
+			before := r.Len()
+			msg, err := dec.Decode()
+			if errors.Is(err, io.EOF) {
+				require.Zero(t, before)
+				return
+			} else if err != nil {
+				if !errors.Is(err, ErrFrameTruncated) && !errors.Is(err, ErrFrameCorrupted) {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				return
+			}
+
+			// the decoder never reads past the end of a frame
+			require.Equal(t, before-r.Len(), 1+len(msg)+frameCrcSize)
+			require.NotEmpty(t, msg)
+		}
+	})
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add([]byte{CommandPing})
+	f.Add([]byte("pinpin"))
+	f.Add(make([]byte, MaxFrameMessageSize+1))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		frame, err := AppendFrame(nil, msg)
+		if len(msg) == 0 {
+			require.ErrorIs(t, err, ErrFrameEmpty)
+			return
+		} else if len(msg) > MaxFrameMessageSize {
+			require.ErrorIs(t, err, ErrFrameTooLarge)
+			return
+		}
+		require.NoError(t, err)
+
+		// raw data may follow the frame
+		dec := NewFrameDecoder(bytes.NewReader(append(frame, msg...)))
+		got, err := dec.Decode()
+		require.NoError(t, err)
+		require.Equal(t, msg, got)
+	})
+}
@@ -1,9 +1,16 @@
 package pinpin
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"iter"
+	"math"
+	"slices"
 )
 
 // Code ported from https://github.com/djokeur/merlinator/blob/main/src/io_utils.py
@@ -19,15 +26,26 @@ type PlaylistItem struct {
 	Order         uint16
 	ParentID      uint16
 	Title         string
+	// raw is the record as read from `playlist.bin`. When set, EncodePlaylistBin
+	// starts from it, so the bytes unknown to this package are kept. It is a
+	// string for PlaylistItem to remain comparable.
+	raw string
 }
 
+const (
+	PlaylistItemSize = 152
+
+	PlaylistFileNameMaxLen = 64
+	PlaylistTitleMaxLen    = 66
+)
+
 type PlaylistItemKind = uint16
 
 const (
 	PlaylistItemKindRoot           PlaylistItemKind = 0x0001
 	PlaylistItemKindFolder         PlaylistItemKind = 0x0002
 	PlaylistItemKindAudio          PlaylistItemKind = 0x0004
-	PlaylistItemKindFolderFavorite PlaylistItemKind = 0x000a
+	PlaylistItemKindFolderFavorite PlaylistItemKind = 0x000a // see CheckPlaylistFavorite
 	PlaylistItemKindMask           PlaylistItemKind = 0x000f
 	PlaylistItemKindDiscoverMask   PlaylistItemKind = 0x0010
 )
@@ -40,42 +58,190 @@ type PlaylistTreeNode struct {
 	LimitTimeUnixPtr *uint32             `json:"limit_time,omitempty"`
 	Favorite         int                 `json:"favorite,omitempty"`
 	Discover         int                 `json:"discover,omitempty"`
+	// FavoriteOrder is the rank of a favorite track in `playlist.bin`. It is
+	// carried through `playlist.json` as `favorite_order`, a key of pinpin's,
+	// so a playlist pulled and uploaded again keeps the order of its
+	// favorites. A favorite without rank is ranked by FlattenPlaylistTree.
+	FavoriteOrder uint16 `json:"favorite_order,omitempty"`
+	// Item is the record the node was built from by BuildPlaylistTree, as
+	// decoded. It is not updated by the edits of the node; FlattenPlaylistTree
+	// only takes its raw record, to keep its unknown bytes.
+	Item *PlaylistItem `json:"-"`
 }
 
-func DecodePlaylistBin(buf []byte) (pis []PlaylistItem, err error) {
-	defer func() {
-		if rvr := recover(); rvr != nil {
-			err = fmt.Errorf("unexpected protocol: %v", rvr)
+func DecodePlaylistBin(buf []byte) ([]PlaylistItem, error) {
+	pis := make([]PlaylistItem, 0, len(buf)/PlaylistItemSize)
+	for pi, err := range NewPlaylistReader(bytes.NewReader(buf)).Items() {
+		if err != nil {
+			return nil, err
 		}
-	}()
+		pis = append(pis, pi)
+	}
 
-	var idx int
-	for idx < len(buf) {
-		var pi PlaylistItem
-
-		cur := buf[idx:]
-		pi.ID = binary.LittleEndian.Uint16(cur[0:2])
-		pi.ParentID = binary.LittleEndian.Uint16(cur[2:4])
-		pi.Order = binary.LittleEndian.Uint16(cur[4:6])
-		pi.ChildrenCount = binary.LittleEndian.Uint16(cur[6:8])
-		pi.FavoriteOrder = binary.LittleEndian.Uint16(cur[8:10])
-		pi.Kind = binary.LittleEndian.Uint16(cur[10:12])
-		pi.LimitTimeUnix = binary.LittleEndian.Uint32(cur[12:16])
-		pi.AddTimeUnix = binary.LittleEndian.Uint32(cur[16:20])
-		fileNameLen := int(cur[20])
-		pi.FileName = string(cur[21 : 21+fileNameLen])
-		titleLen := int(cur[85])
-		pi.Title = string(cur[86 : 86+titleLen])
+	return pis, nil
+}
 
-		pis = append(pis, pi)
+// PlaylistRecordError is returned when a record of `playlist.bin` is
+// malformed or truncated.
+type PlaylistRecordError struct {
+	Index  int
+	Offset int64
+	Err    error
+}
+
+func (e *PlaylistRecordError) Error() string {
+	return fmt.Sprintf("record #%d at offset %d: %s", e.Index, e.Offset, e.Err.Error())
+}
+
+func (e *PlaylistRecordError) Unwrap() error {
+	return e.Err
+}
 
-		idx = idx + 152
+// PlaylistReader decodes `playlist.bin` one record at a time, such as
+// straight from Conn.OpenFile.
+type PlaylistReader struct {
+	r      io.Reader
+	index  int
+	offset int64
+	buf    [PlaylistItemSize]byte
+}
+
+func NewPlaylistReader(r io.Reader) *PlaylistReader {
+	return &PlaylistReader{
+		r: r,
+	}
+}
+
+// Read decodes the next record. It returns io.EOF after the last one. On a
+// malformed record, the item is returned along with a *PlaylistRecordError and
+// the next call reads the following record.
+func (pr *PlaylistReader) Read() (PlaylistItem, error) {
+	n, err := io.ReadFull(pr.r, pr.buf[:])
+	if err == io.EOF {
+		return PlaylistItem{}, io.EOF
+	} else if err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: %dB left", ErrPlaylistTruncated, n)
+	}
+
+	recErr := &PlaylistRecordError{Index: pr.index, Offset: pr.offset}
+	pr.index++
+	pr.offset += int64(n)
+	if err != nil {
+		recErr.Err = err
+		return PlaylistItem{}, recErr
 	}
 
+	pi, err := decodePlaylistRecord(pr.buf[:])
+	if err != nil {
+		recErr.Err = err
+		return pi, recErr
+	}
+	return pi, nil
+}
+
+// Items iterates over the records left. It stops after a read error, but not
+// after a malformed record.
+func (pr *PlaylistReader) Items() iter.Seq2[PlaylistItem, error] {
+	return func(yield func(PlaylistItem, error) bool) {
+		for {
+			pi, err := pr.Read()
+			if err == io.EOF {
+				return
+			} else if !yield(pi, err) {
+				return
+			}
+
+			var recErr *PlaylistRecordError
+			if errors.As(err, &recErr) && !isPlaylistRecordMalformed(recErr.Err) {
+				return
+			}
+		}
+	}
+}
+
+func isPlaylistRecordMalformed(err error) bool {
+	return errors.Is(err, ErrPlaylistFileNameTooLong) || errors.Is(err, ErrPlaylistTitleTooLong)
+}
+
+// decodePlaylistRecord decodes a record of `PlaylistItemSize` bytes. On error,
+// the item is still returned with its strings cut to their field.
+func decodePlaylistRecord(cur []byte) (pi PlaylistItem, err error) {
+	pi.raw = string(cur)
+	pi.ID = binary.LittleEndian.Uint16(cur[0:2])
+	pi.ParentID = binary.LittleEndian.Uint16(cur[2:4])
+	pi.Order = binary.LittleEndian.Uint16(cur[4:6])
+	pi.ChildrenCount = binary.LittleEndian.Uint16(cur[6:8])
+	pi.FavoriteOrder = binary.LittleEndian.Uint16(cur[8:10])
+	pi.Kind = binary.LittleEndian.Uint16(cur[10:12])
+	pi.LimitTimeUnix = binary.LittleEndian.Uint32(cur[12:16])
+	pi.AddTimeUnix = binary.LittleEndian.Uint32(cur[16:20])
+
+	fileNameLen := int(cur[20])
+	if fileNameLen > PlaylistFileNameMaxLen {
+		err = fmt.Errorf("%w: length %dB, max %dB", ErrPlaylistFileNameTooLong, fileNameLen, PlaylistFileNameMaxLen)
+		fileNameLen = PlaylistFileNameMaxLen
+	}
+	pi.FileName = string(cur[21 : 21+fileNameLen])
+
+	titleLen := int(cur[85])
+	if titleLen > PlaylistTitleMaxLen && err == nil {
+		err = fmt.Errorf("%w: length %dB, max %dB", ErrPlaylistTitleTooLong, titleLen, PlaylistTitleMaxLen)
+	}
+	pi.Title = string(cur[86 : 86+min(titleLen, PlaylistTitleMaxLen)])
+
 	return
 }
 
+func EncodePlaylistBin(items []PlaylistItem) ([]byte, error) {
+	buf := make([]byte, len(items)*PlaylistItemSize)
+	for idx, pi := range items {
+		if len(pi.FileName) > PlaylistFileNameMaxLen {
+			return nil, fmt.Errorf("item #%d: %w: '%s' is %dB long, max %dB", idx, ErrPlaylistFileNameTooLong, pi.FileName, len(pi.FileName), PlaylistFileNameMaxLen)
+		} else if len(pi.Title) > PlaylistTitleMaxLen {
+			return nil, fmt.Errorf("item #%d: %w: '%s' is %dB long, max %dB", idx, ErrPlaylistTitleTooLong, pi.Title, len(pi.Title), PlaylistTitleMaxLen)
+		}
+
+		cur := buf[idx*PlaylistItemSize : (idx+1)*PlaylistItemSize]
+		if len(pi.raw) == PlaylistItemSize {
+			copy(cur, pi.raw)
+		}
+
+		binary.LittleEndian.PutUint16(cur[0:2], pi.ID)
+		binary.LittleEndian.PutUint16(cur[2:4], pi.ParentID)
+		binary.LittleEndian.PutUint16(cur[4:6], pi.Order)
+		binary.LittleEndian.PutUint16(cur[6:8], pi.ChildrenCount)
+		binary.LittleEndian.PutUint16(cur[8:10], pi.FavoriteOrder)
+		binary.LittleEndian.PutUint16(cur[10:12], pi.Kind)
+		binary.LittleEndian.PutUint32(cur[12:16], pi.LimitTimeUnix)
+		binary.LittleEndian.PutUint32(cur[16:20], pi.AddTimeUnix)
+		putPlaylistString(cur[20:21+PlaylistFileNameMaxLen], pi.FileName)
+		putPlaylistString(cur[85:86+PlaylistTitleMaxLen], pi.Title)
+	}
+
+	return buf, nil
+}
+
+// putPlaylistString writes `s` after its length in `field`. The rest of the
+// previous string is cleared, but the bytes following it are kept.
+func putPlaylistString(field []byte, s string) {
+	oldLen := min(int(field[0]), len(field)-1)
+
+	field[0] = byte(len(s))
+	n := copy(field[1:], s)
+	if oldLen > n {
+		clear(field[1+n : 1+oldLen])
+	}
+}
+
 func BuildPlaylistTree(items []PlaylistItem) ([]*PlaylistTreeNode, error) {
+	nodes, _, err := BuildPlaylistTreeWithUnreachable(items)
+	return nodes, err
+}
+
+// BuildPlaylistTreeWithUnreachable is BuildPlaylistTree, also returning the
+// items out of the tree, such as orphans or parent cycles, as trees of their
+// own in the order of `items`.
+func BuildPlaylistTreeWithUnreachable(items []PlaylistItem) (nodes []*PlaylistTreeNode, unreachable []*PlaylistTreeNode, err error) {
 	// search for root
 	rootId, has := func() (uint16, bool) {
 		for _, item := range items {
@@ -86,48 +252,176 @@ func BuildPlaylistTree(items []PlaylistItem) ([]*PlaylistTreeNode, error) {
 		return 0, false
 	}()
 	if !has {
-		return nil, fmt.Errorf("unable to find root node")
+		return nil, nil, fmt.Errorf("unable to find root node")
+	}
+
+	// a duplicated ID could make the walk loop forever
+	ids := make(map[uint16]bool, len(items))
+	for _, item := range items {
+		if ids[item.ID] {
+			return nil, nil, fmt.Errorf("%w: %d", ErrPlaylistDuplicateID, item.ID)
+		}
+		ids[item.ID] = true
 	}
 
-	return walkPlaylist(items, rootId)
+	visited := map[uint16]bool{rootId: true}
+	nodes = walkPlaylist(items, rootId, visited)
+
+	// the topmost unreachable items first, then the ones of parent cycles
+	for _, item := range items {
+		if !visited[item.ID] && (!ids[item.ParentID] || visited[item.ParentID]) {
+			unreachable = append(unreachable, newPlaylistTreeNode(items, item, visited))
+		}
+	}
+	for _, item := range items {
+		if !visited[item.ID] {
+			unreachable = append(unreachable, newPlaylistTreeNode(items, item, visited))
+		}
+	}
+
+	return nodes, unreachable, nil
 }
 
-func walkPlaylist(items []PlaylistItem, parentId uint16) (children []*PlaylistTreeNode, err error) {
+// walkPlaylist builds the children of `parentId` not yet `visited`.
+func walkPlaylist(items []PlaylistItem, parentId uint16, visited map[uint16]bool) (children []*PlaylistTreeNode) {
+	var siblings []PlaylistItem
 	for _, item := range items {
-		if item.ID == parentId || item.ParentID != parentId {
-			continue
+		// the root may have a parent, which would make the walk loop
+		if item.ParentID == parentId && !visited[item.ID] && item.Kind != PlaylistItemKindRoot {
+			siblings = append(siblings, item)
 		}
+	}
+
+	// records are not necessarily stored in the order of the playlist
+	slices.SortStableFunc(siblings, func(a, b PlaylistItem) int {
+		return cmp.Compare(a.Order, b.Order)
+	})
+
+	for _, item := range siblings {
+		if !visited[item.ID] {
+			children = append(children, newPlaylistTreeNode(items, item, visited))
+		}
+	}
+	return
+}
 
-		var kind PlaylistItemKind = item.Kind & 0x000f
-		discoverMask := item.Kind & PlaylistItemKindDiscoverMask
+func newPlaylistTreeNode(items []PlaylistItem, item PlaylistItem, visited map[uint16]bool) *PlaylistTreeNode {
+	visited[item.ID] = true
 
-		node := new(PlaylistTreeNode)
-		children = append(children, node)
+	var kind PlaylistItemKind = item.Kind & 0x000f
+	discoverMask := item.Kind & PlaylistItemKindDiscoverMask
 
-		node.UUID = item.FileName
-		node.Title = item.Title
-		if item.Kind == PlaylistItemKindAudio {
-			node.AddTimeUnix = item.AddTimeUnix
-			node.LimitTimeUnixPtr = &item.LimitTimeUnix
+	node := new(PlaylistTreeNode)
+	node.UUID = item.FileName
+	node.Title = item.Title
+	node.FavoriteOrder = item.FavoriteOrder
+	node.Item = &item
+	if kind == PlaylistItemKindAudio {
+		node.AddTimeUnix = item.AddTimeUnix
+		node.LimitTimeUnixPtr = &item.LimitTimeUnix
+	}
+
+	node.Children = walkPlaylist(items, item.ID, visited)
+
+	if kind == PlaylistItemKindFolder || kind == PlaylistItemKindFolderFavorite {
+		if node.Children == nil {
+			node.Children = make([]*PlaylistTreeNode, 0)
 		}
+	}
 
-		node.Children, err = walkPlaylist(items, item.ID)
-		if err != nil {
-			return
+	if kind == PlaylistItemKindFolderFavorite || (kind == PlaylistItemKindAudio && item.FavoriteOrder != 0) {
+		node.Favorite = 1
+	}
+
+	if discoverMask != 0 {
+		node.Discover = 1
+	}
+	return node
+}
+
+// FlattenPlaylistTree is the inverse of BuildPlaylistTree: it numbers the
+// nodes depth-first under a root item of ID 1, as the firmware does when
+// converting `playlist.json`.
+func FlattenPlaylistTree(nodes []*PlaylistTreeNode) ([]PlaylistItem, error) {
+	items := []PlaylistItem{{
+		ID:            1,
+		Kind:          PlaylistItemKindRoot,
+		ChildrenCount: uint16(len(nodes)),
+	}}
+
+	// favorites without an order are put after the ordered ones
+	favoriteOrder := maxFavoriteOrder(nodes)
+	var flatten func(nodes []*PlaylistTreeNode, parentId uint16) error
+	flatten = func(nodes []*PlaylistTreeNode, parentId uint16) error {
+		if len(nodes) > math.MaxUint16 {
+			return fmt.Errorf("too many children: %d", len(nodes))
 		}
 
-		if kind == PlaylistItemKindFolder || kind == PlaylistItemKindFolderFavorite {
-			if node.Children == nil {
-				node.Children = make([]*PlaylistTreeNode, 0)
+		for order, node := range nodes {
+			if node == nil {
+				return fmt.Errorf("unexpected nil node")
+			} else if len(items) >= math.MaxUint16 {
+				return fmt.Errorf("too many nodes")
+			}
+
+			item := PlaylistItem{
+				ID:            uint16(len(items) + 1),
+				ParentID:      parentId,
+				Order:         uint16(order),
+				ChildrenCount: uint16(len(node.Children)),
+				FileName:      node.UUID,
+				Title:         node.Title,
+				AddTimeUnix:   node.AddTimeUnix,
+				FavoriteOrder: node.FavoriteOrder,
 			}
-		}
 
-		if kind == PlaylistItemKindFolderFavorite {
-			node.Favorite = 1
+			if node.Item != nil {
+				item.raw = node.Item.raw
+			}
+
+			if node.LimitTimeUnixPtr != nil {
+				item.LimitTimeUnix = *node.LimitTimeUnixPtr
+			}
+
+			if node.Children != nil {
+				item.Kind = PlaylistItemKindFolder
+				if node.Favorite != 0 {
+					item.Kind = PlaylistItemKindFolderFavorite
+				}
+			} else {
+				item.Kind = PlaylistItemKindAudio
+				if node.Favorite == 0 {
+					item.FavoriteOrder = 0
+				} else if item.FavoriteOrder == 0 {
+					favoriteOrder++
+					item.FavoriteOrder = favoriteOrder
+				}
+			}
+
+			if node.Discover != 0 {
+				item.Kind |= PlaylistItemKindDiscoverMask
+			}
+
+			items = append(items, item)
+			if err := flatten(node.Children, item.ID); err != nil {
+				return err
+			}
 		}
 
-		if discoverMask != 0 {
-			node.Discover = 1
+		return nil
+	}
+
+	if err := flatten(nodes, 1); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+func maxFavoriteOrder(nodes []*PlaylistTreeNode) (r uint16) {
+	for _, node := range nodes {
+		if node != nil {
+			r = max(r, node.FavoriteOrder, maxFavoriteOrder(node.Children))
 		}
 	}
 	return
@@ -136,3 +430,38 @@ func walkPlaylist(items []PlaylistItem, parentId uint16) (children []*PlaylistTr
 func MarshalPlaylistJson(nodes []*PlaylistTreeNode) ([]byte, error) {
 	return json.Marshal(nodes)
 }
+
+// UnmarshalPlaylistJson parses a `playlist.json`. As with the firmware, a node
+// with a `child` array, even empty, is a folder and a node without is a track.
+func UnmarshalPlaylistJson(raw []byte) ([]*PlaylistTreeNode, error) {
+	var nodes []*PlaylistTreeNode
+	if err := json.Unmarshal(raw, &nodes); err != nil {
+		return nil, err
+	} else if nodes == nil {
+		return nil, fmt.Errorf("unexpected null playlist, expected an array")
+	}
+
+	if err := checkPlaylistJsonNodes(nodes, "/"); err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func checkPlaylistJsonNodes(nodes []*PlaylistTreeNode, path string) error {
+	for idx, node := range nodes {
+		if node == nil {
+			return fmt.Errorf("%s%d: unexpected null node", path, idx)
+		} else if node.Favorite != 0 && node.Favorite != 1 {
+			return fmt.Errorf("%s%d: unexpected favorite %d, expected 0 or 1", path, idx, node.Favorite)
+		} else if node.Discover != 0 && node.Discover != 1 {
+			return fmt.Errorf("%s%d: unexpected discover %d, expected 0 or 1", path, idx, node.Discover)
+		}
+
+		if err := checkPlaylistJsonNodes(node.Children, fmt.Sprintf("%s%d/", path, idx)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
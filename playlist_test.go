@@ -0,0 +1,439 @@
+package pinpin
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testPlaylistItems() []PlaylistItem {
+	return []PlaylistItem{
+		{ID: 1, Kind: PlaylistItemKindRoot, ChildrenCount: 2},
+		{ID: 2, ParentID: 1, Order: 0, ChildrenCount: 2, Kind: PlaylistItemKindFolder, FileName: "folder", Title: "Contes"},
+		{ID: 3, ParentID: 2, Order: 0, Kind: PlaylistItemKindAudio, FileName: "story-1", Title: "Le loup", AddTimeUnix: 1700000000, LimitTimeUnix: 1800000000},
+		{ID: 4, ParentID: 2, Order: 1, Kind: PlaylistItemKindAudio | PlaylistItemKindDiscoverMask, FavoriteOrder: 1, FileName: "story-2", Title: "Les trois petits cochons"},
+		{ID: 5, ParentID: 1, Order: 1, Kind: PlaylistItemKindFolderFavorite, FileName: "favorites", Title: "Favoris"},
+	}
+}
+
+func TestPlaylistBinRoundTrip(t *testing.T) {
+	items := testPlaylistItems()
+	buf, err := EncodePlaylistBin(items)
+	require.NoError(t, err)
+	require.Len(t, buf, len(items)*PlaylistItemSize)
+
+	decoded, err := DecodePlaylistBin(buf)
+	require.NoError(t, err)
+	require.Len(t, decoded, len(items))
+	for idx := range items {
+		require.Equal(t, string(buf[idx*PlaylistItemSize:(idx+1)*PlaylistItemSize]), decoded[idx].raw)
+		decoded[idx].raw = ""
+	}
+	// the items are comparable
+	require.True(t, items[0] == decoded[0])
+	require.Equal(t, items, decoded)
+
+	// the decoded items encode to the same bytes
+	again, err := EncodePlaylistBin(decoded)
+	require.NoError(t, err)
+	require.Equal(t, buf, again)
+}
+
+func TestPlaylistBinUnknownBytes(t *testing.T) {
+	buf, err := EncodePlaylistBin(testPlaylistItems())
+	require.NoError(t, err)
+
+	// unknown bytes past the strings of the records
+	for idx := range len(buf) / PlaylistItemSize {
+		record := buf[idx*PlaylistItemSize : (idx+1)*PlaylistItemSize]
+		for _, field := range [][]byte{record[20 : 21+PlaylistFileNameMaxLen], record[85 : 86+PlaylistTitleMaxLen]} {
+			for i := 1 + int(field[0]); i < len(field); i++ {
+				field[i] = byte(0xa0 + i)
+			}
+		}
+	}
+
+	items, err := DecodePlaylistBin(buf)
+	require.NoError(t, err)
+
+	// unchanged, the records are identical
+	again, err := EncodePlaylistBin(items)
+	require.NoError(t, err)
+	require.Equal(t, buf, again)
+
+	// a shorter title and a longer file name keep the bytes past the
+	// previous strings
+	story := items[3]
+	story.Title = "Cochons"
+	story.FileName = "story-2-with-a-longer-name"
+	again, err = EncodePlaylistBin([]PlaylistItem{story})
+	require.NoError(t, err)
+
+	old := buf[3*PlaylistItemSize : 4*PlaylistItemSize]
+	oldFileNameEnd := 21 + int(old[20])
+	oldTitleEnd := 86 + int(old[85])
+	newFileNameEnd := 21 + len(story.FileName)
+	require.Equal(t, old[:20], again[:20])
+	require.Equal(t, byte(len(story.FileName)), again[20])
+	require.Equal(t, story.FileName, string(again[21:newFileNameEnd]))
+	require.Equal(t, old[newFileNameEnd:85], again[newFileNameEnd:85])
+	require.Equal(t, byte(len(story.Title)), again[85])
+	require.Equal(t, story.Title, string(again[86:86+len(story.Title)]))
+	require.Equal(t, make([]byte, oldTitleEnd-86-len(story.Title)), again[86+len(story.Title):oldTitleEnd])
+	require.Equal(t, old[oldTitleEnd:], again[oldTitleEnd:])
+	require.Greater(t, newFileNameEnd, oldFileNameEnd)
+
+	decoded, err := DecodePlaylistBin(again)
+	require.NoError(t, err)
+	require.Equal(t, story.Title, decoded[0].Title)
+	require.Equal(t, story.FileName, decoded[0].FileName)
+}
+
+func TestPlaylistBinMaxLengths(t *testing.T) {
+	items := []PlaylistItem{{
+		ID:       1,
+		Kind:     PlaylistItemKindRoot,
+		FileName: strings.Repeat("f", PlaylistFileNameMaxLen),
+		Title:    strings.Repeat("t", PlaylistTitleMaxLen),
+	}}
+	buf, err := EncodePlaylistBin(items)
+	require.NoError(t, err)
+
+	decoded, err := DecodePlaylistBin(buf)
+	require.NoError(t, err)
+	require.Equal(t, items[0].FileName, decoded[0].FileName)
+	require.Equal(t, items[0].Title, decoded[0].Title)
+}
+
+func TestPlaylistBinLengthRejections(t *testing.T) {
+	items := testPlaylistItems()
+	items[2].FileName = strings.Repeat("f", PlaylistFileNameMaxLen+1)
+	_, err := EncodePlaylistBin(items)
+	require.ErrorIs(t, err, ErrPlaylistFileNameTooLong)
+	require.ErrorContains(t, err, "item #2")
+
+	items = testPlaylistItems()
+	items[3].Title = strings.Repeat("t", PlaylistTitleMaxLen+1)
+	_, err = EncodePlaylistBin(items)
+	require.ErrorIs(t, err, ErrPlaylistTitleTooLong)
+	require.ErrorContains(t, err, "item #3")
+
+	// lengths past the fields in a record
+	buf, err := EncodePlaylistBin(testPlaylistItems())
+	require.NoError(t, err)
+	buf[2*PlaylistItemSize+20] = PlaylistFileNameMaxLen + 1
+	_, err = DecodePlaylistBin(buf)
+	require.ErrorIs(t, err, ErrPlaylistFileNameTooLong)
+
+	buf, err = EncodePlaylistBin(testPlaylistItems())
+	require.NoError(t, err)
+	buf[3*PlaylistItemSize+85] = 0xff
+	_, err = DecodePlaylistBin(buf)
+	require.ErrorIs(t, err, ErrPlaylistTitleTooLong)
+
+	var recErr *PlaylistRecordError
+	require.ErrorAs(t, err, &recErr)
+	require.Equal(t, 3, recErr.Index)
+	require.Equal(t, int64(3*PlaylistItemSize), recErr.Offset)
+}
+
+func TestPlaylistBinTruncated(t *testing.T) {
+	buf, err := EncodePlaylistBin(testPlaylistItems())
+	require.NoError(t, err)
+
+	_, err = DecodePlaylistBin(buf[:len(buf)-1])
+	require.ErrorIs(t, err, ErrPlaylistTruncated)
+}
+
+func TestPlaylistReader(t *testing.T) {
+	items := testPlaylistItems()
+	buf, err := EncodePlaylistBin(items)
+	require.NoError(t, err)
+
+	// two malformed records, and the last one truncated
+	buf[1*PlaylistItemSize+20] = PlaylistFileNameMaxLen + 1
+	buf[3*PlaylistItemSize+85] = PlaylistTitleMaxLen + 1
+	buf = buf[:len(buf)-10]
+
+	// read a byte at a time
+	pr := NewPlaylistReader(iotest.OneByteReader(bytes.NewReader(buf)))
+	var decoded []PlaylistItem
+	var recErrs []*PlaylistRecordError
+	for pi, err := range pr.Items() {
+		decoded = append(decoded, pi)
+
+		var recErr *PlaylistRecordError
+		if err != nil {
+			require.ErrorAs(t, err, &recErr)
+		}
+		recErrs = append(recErrs, recErr)
+	}
+
+	// the malformed records do not stop the iteration, the truncated one does
+	require.Len(t, decoded, len(items))
+	require.Nil(t, recErrs[0])
+	require.Equal(t, items[0].Title, decoded[0].Title)
+	require.Nil(t, recErrs[2])
+	require.Equal(t, items[2].FileName, decoded[2].FileName)
+
+	require.ErrorIs(t, recErrs[1], ErrPlaylistFileNameTooLong)
+	require.Equal(t, 1, recErrs[1].Index)
+	require.Equal(t, int64(1*PlaylistItemSize), recErrs[1].Offset)
+	require.Equal(t, items[1].ID, decoded[1].ID)
+
+	require.ErrorIs(t, recErrs[3], ErrPlaylistTitleTooLong)
+	require.Equal(t, 3, recErrs[3].Index)
+	require.Equal(t, int64(3*PlaylistItemSize), recErrs[3].Offset)
+	require.Equal(t, items[3].FileName, decoded[3].FileName)
+
+	require.ErrorIs(t, recErrs[4], ErrPlaylistTruncated)
+	require.Equal(t, 4, recErrs[4].Index)
+	require.Equal(t, int64(4*PlaylistItemSize), recErrs[4].Offset)
+
+	_, err = pr.Read()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestPlaylistReaderError(t *testing.T) {
+	buf, err := EncodePlaylistBin(testPlaylistItems())
+	require.NoError(t, err)
+
+	// the stream fails after the first record
+	errStream := errors.New("stream failed")
+	pr := NewPlaylistReader(io.MultiReader(bytes.NewReader(buf[:PlaylistItemSize]), iotest.ErrReader(errStream)))
+
+	var errs []error
+	for _, err := range pr.Items() {
+		errs = append(errs, err)
+	}
+	require.Len(t, errs, 2)
+	require.NoError(t, errs[0])
+	require.ErrorIs(t, errs[1], errStream)
+
+	var recErr *PlaylistRecordError
+	require.ErrorAs(t, errs[1], &recErr)
+	require.Equal(t, 1, recErr.Index)
+}
+
+func TestPlaylistTreeRoundTrip(t *testing.T) {
+	items := testPlaylistItems()
+	nodes, err := BuildPlaylistTree(items)
+	require.NoError(t, err)
+
+	flattened, err := FlattenPlaylistTree(nodes)
+	require.NoError(t, err)
+	buf, err := EncodePlaylistBin(flattened)
+	require.NoError(t, err)
+	decoded, err := DecodePlaylistBin(buf)
+	require.NoError(t, err)
+
+	again, err := BuildPlaylistTree(decoded)
+	require.NoError(t, err)
+	require.Equal(t, len(nodes), len(again))
+	for idx := range nodes {
+		require.Equal(t, nodes[idx].UUID, again[idx].UUID)
+		require.Equal(t, nodes[idx].Title, again[idx].Title)
+		require.Equal(t, nodes[idx].Favorite, again[idx].Favorite)
+		require.Equal(t, len(nodes[idx].Children), len(again[idx].Children))
+	}
+
+	story := again[0].Children[1]
+	require.Equal(t, "story-2", story.UUID)
+	require.Equal(t, 1, story.Favorite)
+	require.Equal(t, 1, story.Discover)
+	require.Equal(t, uint16(1), story.FavoriteOrder)
+}
+
+func TestBuildPlaylistTreeOrder(t *testing.T) {
+	items := testPlaylistItems()
+	// the stories of the folder swapped
+	items[2].Order, items[3].Order = 1, 0
+	// records stored backwards
+	slices.Reverse(items)
+
+	nodes, err := BuildPlaylistTree(items)
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+	require.Equal(t, "folder", nodes[0].UUID)
+	require.Equal(t, "favorites", nodes[1].UUID)
+	require.Len(t, nodes[0].Children, 2)
+	require.Equal(t, "story-2", nodes[0].Children[0].UUID)
+	require.Equal(t, "story-1", nodes[0].Children[1].UUID)
+
+	// flattened back in the order of the tree
+	flattened, err := FlattenPlaylistTree(nodes)
+	require.NoError(t, err)
+	require.Equal(t, "story-2", flattened[2].FileName)
+	require.Equal(t, uint16(0), flattened[2].Order)
+	require.Equal(t, "story-1", flattened[3].FileName)
+	require.Equal(t, uint16(1), flattened[3].Order)
+}
+
+func TestPlaylistJsonFavoriteOrder(t *testing.T) {
+	items := testPlaylistItems()
+	items[3].FavoriteOrder = 7
+	nodes, err := BuildPlaylistTree(items)
+	require.NoError(t, err)
+	require.Equal(t, uint16(7), nodes[0].Children[1].FavoriteOrder)
+
+	raw, err := MarshalPlaylistJson(nodes)
+	require.NoError(t, err)
+	require.Contains(t, string(raw), `"favorite_order":7`)
+
+	parsed, err := UnmarshalPlaylistJson(raw)
+	require.NoError(t, err)
+	story := parsed[0].Children[1]
+	require.Equal(t, 1, story.Favorite)
+	require.Equal(t, uint16(7), story.FavoriteOrder)
+
+	// a new favorite is ranked after the others
+	parsed[0].Children[0].Favorite = 1
+	flattened, err := FlattenPlaylistTree(parsed)
+	require.NoError(t, err)
+	require.Equal(t, "story-1", flattened[2].FileName)
+	require.Equal(t, uint16(8), flattened[2].FavoriteOrder)
+	require.Equal(t, "story-2", flattened[3].FileName)
+	require.Equal(t, uint16(7), flattened[3].FavoriteOrder)
+}
+
+func TestUnmarshalPlaylistJson(t *testing.T) {
+	nodes, err := UnmarshalPlaylistJson([]byte(`[
+		{"uuid": "folder", "title": "Contes", "child": [
+			{"uuid": "empty", "title": "Vide", "child": []},
+			{"uuid": "story", "title": "Le loup", "add_time": 1700000000, "favorite": 1}
+		]}
+	]`))
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	require.Len(t, nodes[0].Children, 2)
+
+	// an empty `child` is a folder, a missing one a track
+	empty, story := nodes[0].Children[0], nodes[0].Children[1]
+	require.NotNil(t, empty.Children)
+	require.Empty(t, empty.Children)
+	require.Nil(t, story.Children)
+	require.Equal(t, uint32(1700000000), story.AddTimeUnix)
+
+	items, err := FlattenPlaylistTree(nodes)
+	require.NoError(t, err)
+	require.Equal(t, PlaylistItemKindFolder, items[2].Kind)
+	require.Equal(t, PlaylistItemKindAudio, items[3].Kind)
+
+	// marshalled back the same
+	raw, err := MarshalPlaylistJson(nodes)
+	require.NoError(t, err)
+	require.JSONEq(t, `[
+		{"uuid": "folder", "title": "Contes", "child": [
+			{"uuid": "empty", "title": "Vide", "child": []},
+			{"uuid": "story", "title": "Le loup", "add_time": 1700000000, "favorite": 1}
+		]}
+	]`, string(raw))
+
+	for _, raw := range []string{
+		`null`,
+		`{}`,
+		`[null]`,
+		`[{"uuid": "story", "favorite": 2}]`,
+		`[{"uuid": "folder", "child": [{"uuid": "story", "discover": 2}]}]`,
+	} {
+		_, err := UnmarshalPlaylistJson([]byte(raw))
+		require.Error(t, err, raw)
+	}
+}
+
+func TestBuildPlaylistTreeWithUnreachable(t *testing.T) {
+	items := append(testPlaylistItems(),
+		// an orphan with a child
+		PlaylistItem{ID: 6, ParentID: 42, ChildrenCount: 1, Kind: PlaylistItemKindFolder, FileName: "orphan"},
+		PlaylistItem{ID: 7, ParentID: 6, Kind: PlaylistItemKindAudio, FileName: "orphan-child"},
+		// a parent cycle
+		PlaylistItem{ID: 8, ParentID: 9, ChildrenCount: 1, Kind: PlaylistItemKindFolder, FileName: "cycle-1"},
+		PlaylistItem{ID: 9, ParentID: 8, ChildrenCount: 1, Kind: PlaylistItemKindFolder, FileName: "cycle-2"},
+	)
+
+	nodes, unreachable, err := BuildPlaylistTreeWithUnreachable(items)
+	require.NoError(t, err)
+	require.Len(t, nodes, 2)
+	require.Equal(t, uint16(2), nodes[0].Item.ID)
+
+	require.Len(t, unreachable, 2)
+	require.Equal(t, "orphan", unreachable[0].UUID)
+	require.Equal(t, "orphan-child", unreachable[0].Children[0].UUID)
+	require.Equal(t, uint16(7), unreachable[0].Children[0].Item.ID)
+	require.Equal(t, "cycle-1", unreachable[1].UUID)
+	require.Equal(t, "cycle-2", unreachable[1].Children[0].UUID)
+	require.Empty(t, unreachable[1].Children[0].Children)
+}
+
+func TestBuildPlaylistTreeWithUnreachableNone(t *testing.T) {
+	items := testPlaylistItems()
+	nodes, unreachable, err := BuildPlaylistTreeWithUnreachable(items)
+	require.NoError(t, err)
+	require.Empty(t, unreachable)
+
+	// the tree of BuildPlaylistTree
+	built, err := BuildPlaylistTree(items)
+	require.NoError(t, err)
+	require.Equal(t, built, nodes)
+
+	_, _, err = BuildPlaylistTreeWithUnreachable(items[1:])
+	require.ErrorContains(t, err, "unable to find root node")
+
+	items[4].ID = 2
+	_, _, err = BuildPlaylistTreeWithUnreachable(items)
+	require.ErrorIs(t, err, ErrPlaylistDuplicateID)
+}
+
+func TestPlaylistTreeNodeItem(t *testing.T) {
+	buf, err := EncodePlaylistBin(testPlaylistItems())
+	require.NoError(t, err)
+	// unknown bytes past the title of the story
+	story := buf[2*PlaylistItemSize : 3*PlaylistItemSize]
+	story[PlaylistItemSize-1] = 0xa5
+
+	items, err := DecodePlaylistBin(buf)
+	require.NoError(t, err)
+	nodes, err := BuildPlaylistTree(items)
+	require.NoError(t, err)
+
+	// each node has the item it was built from
+	var byID []PlaylistItem
+	walkPlaylistTree(nodes, func(node *PlaylistTreeNode) {
+		require.NotNil(t, node.Item, node.UUID)
+		byID = append(byID, *node.Item)
+	})
+	require.Equal(t, items[1:], byID)
+
+	// it is not updated by the edits, and only its unknown bytes are kept
+	node := nodes[0].Children[0]
+	node.Title = "El lobo"
+	require.Equal(t, "Le loup", node.Item.Title)
+
+	flattened, err := FlattenPlaylistTree(nodes)
+	require.NoError(t, err)
+	again, err := EncodePlaylistBin(flattened)
+	require.NoError(t, err)
+	require.Equal(t, "El lobo", flattened[2].Title)
+	require.Equal(t, byte(0xa5), again[3*PlaylistItemSize-1])
+
+	// it is not part of playlist.json
+	raw, err := MarshalPlaylistJson(nodes)
+	require.NoError(t, err)
+	require.NotContains(t, string(raw), `"Item"`)
+	parsed, err := UnmarshalPlaylistJson(raw)
+	require.NoError(t, err)
+	require.Nil(t, parsed[0].Children[0].Item)
+
+	// without it, the record starts from zero
+	flattened, err = FlattenPlaylistTree(parsed)
+	require.NoError(t, err)
+	again, err = EncodePlaylistBin(flattened)
+	require.NoError(t, err)
+	require.Zero(t, again[3*PlaylistItemSize-1])
+}
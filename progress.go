@@ -0,0 +1,73 @@
+package pinpin
+
+import (
+	"io"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+type TransferDirection int
+
+const (
+	TransferDownload TransferDirection = iota
+	TransferUpload
+)
+
+// ProgressReporter is notified of the progress of file transfers. A Conn
+// never runs two transfers at once, so a reporter sees at most one transfer
+// between `Start` and `Finish`.
+type ProgressReporter interface {
+	Start(direction TransferDirection, name string, size int64)
+	Advance(n int64)
+	Finish()
+}
+
+type nopProgressReporter struct{}
+
+func (nopProgressReporter) Start(TransferDirection, string, int64) {}
+func (nopProgressReporter) Advance(int64)                          {}
+func (nopProgressReporter) Finish()                                {}
+
+// ProgressBarReporter draws a progress bar on stderr for each transfer.
+type ProgressBarReporter struct {
+	bar *progressbar.ProgressBar
+}
+
+func NewProgressBarReporter() *ProgressBarReporter {
+	return new(ProgressBarReporter)
+}
+
+func (r *ProgressBarReporter) Start(direction TransferDirection, name string, size int64) {
+	description := "reading " + name
+	if direction == TransferUpload {
+		description = "writing " + name
+	}
+
+	r.bar = progressbar.DefaultBytes(size, description)
+}
+
+func (r *ProgressBarReporter) Advance(n int64) {
+	if r.bar != nil {
+		r.bar.Add64(n)
+	}
+}
+
+func (r *ProgressBarReporter) Finish() {
+	if r.bar != nil {
+		r.bar.Close()
+		r.bar = nil
+	}
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress ProgressReporter
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.progress.Advance(int64(n))
+	}
+	return n, err
+}
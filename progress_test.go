@@ -0,0 +1,91 @@
+package pinpin_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+type progressTransfer struct {
+	direction pinpin.TransferDirection
+	name      string
+	size      int64
+	advanced  int64
+	finished  int
+}
+
+// recordingReporter records the transfers it is notified of.
+type recordingReporter struct {
+	t         *testing.T
+	transfers []*progressTransfer
+}
+
+func (r *recordingReporter) current() *progressTransfer {
+	require.NotEmpty(r.t, r.transfers, "no transfer started")
+	return r.transfers[len(r.transfers)-1]
+}
+
+func (r *recordingReporter) Start(direction pinpin.TransferDirection, name string, size int64) {
+	if len(r.transfers) > 0 {
+		require.Equal(r.t, 1, r.current().finished, "transfer started before the previous one finished")
+	}
+	r.transfers = append(r.transfers, &progressTransfer{direction: direction, name: name, size: size})
+}
+
+func (r *recordingReporter) Advance(n int64) {
+	require.Zero(r.t, r.current().finished, "advance after finish")
+	r.current().advanced += n
+}
+
+func (r *recordingReporter) Finish() {
+	r.current().finished++
+}
+
+func TestProgressReporter(t *testing.T) {
+	reporter := &recordingReporter{t: t}
+	_, c := simtest.Dial(t, pinpin.WithProgressReporter(reporter))
+
+	data := bytes.Repeat([]byte("pinpin"), 10000)
+	require.NoError(t, c.UploadBytes("story.mp3", data))
+	require.NoError(t, c.GetFile("story.mp3", io.Discard))
+
+	// only file transfers are reported
+	require.NoError(t, c.Ping())
+	_, err := c.LookupFileInformation("story.mp3", true)
+	require.NoError(t, err)
+
+	// closed early
+	r, _, err := c.OpenFile("story.mp3")
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+
+	require.Len(t, reporter.transfers, 3)
+	require.Equal(t, &progressTransfer{pinpin.TransferUpload, "story.mp3", int64(len(data)), int64(len(data)), 1}, reporter.transfers[0])
+	require.Equal(t, &progressTransfer{pinpin.TransferDownload, "story.mp3", int64(len(data)), int64(len(data)), 1}, reporter.transfers[1])
+	require.Equal(t, &progressTransfer{pinpin.TransferDownload, "story.mp3", int64(len(data)), 0, 1}, reporter.transfers[2])
+}
+
+func TestProgressReporterDefault(t *testing.T) {
+	stderr, err := os.CreateTemp(t.TempDir(), "stderr")
+	require.NoError(t, err)
+	defer stderr.Close()
+
+	oldStderr := os.Stderr
+	os.Stderr = stderr
+	defer func() { os.Stderr = oldStderr }()
+
+	_, c := simtest.Dial(t)
+	data := bytes.Repeat([]byte("pinpin"), 10000)
+	require.NoError(t, c.UploadBytes("story.mp3", data))
+	require.NoError(t, c.GetFile("story.mp3", io.Discard))
+
+	// nothing is drawn
+	fi, err := stderr.Stat()
+	require.NoError(t, err)
+	require.Zero(t, fi.Size())
+}
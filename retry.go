@@ -0,0 +1,263 @@
+package pinpin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+type RetryPolicy struct {
+	// Attempts is the number of times an operation is tried, at least once.
+	Attempts int
+	// Backoff is the wait before the second attempt. It doubles after each
+	// attempt, up to MaxBackoff if set.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// DialTimeout bounds each connection attempt, if set.
+	DialTimeout time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:    10,
+	Backoff:     time.Second,
+	MaxBackoff:  10 * time.Second,
+	DialTimeout: 5 * time.Second,
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for range attempt - 1 {
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+		d *= 2
+	}
+
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+	return d
+}
+
+// Session keeps a connection to a Merlin. When an operation fails because of
+// the network, it reconnects and tries again according to its policy.
+type Session struct {
+	// OnRetry, if set, is called when an attempt failed and another one is
+	// about to be made.
+	OnRetry func(attempt int, err error)
+
+	address string
+	policy  RetryPolicy
+	opts    []Option
+	conn    *Conn
+}
+
+func NewSession(address string, policy RetryPolicy, opts ...Option) *Session {
+	return &Session{
+		address: address,
+		policy:  policy,
+		opts:    opts,
+	}
+}
+
+func (s *Session) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
+
+// Conn returns the connection of the session, connecting if needed.
+func (s *Session) Conn(ctx context.Context) (*Conn, error) {
+	var conn *Conn
+	err := s.Do(ctx, func(_ context.Context, c *Conn) error {
+		conn = c
+		return nil
+	})
+	return conn, err
+}
+
+// connect dials and pings the Merlin, if not already connected.
+func (s *Session) connect(ctx context.Context) (*Conn, error) {
+	if s.conn != nil {
+		return s.conn, nil
+	}
+
+	dialCtx := ctx
+	if s.policy.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, s.policy.DialTimeout)
+		defer cancel()
+	}
+
+	conn, err := DialContext(dialCtx, s.address, s.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect: %w", err)
+	}
+
+	if err := conn.PingContext(dialCtx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to ping: %w", err)
+	}
+
+	s.conn = conn
+	return conn, nil
+}
+
+// Do runs `op` on the connection of the session. If `op` fails because of the
+// network, the session reconnects and runs `op` again, so `op` must be safe to
+// retry.
+func (s *Session) Do(ctx context.Context, op func(ctx context.Context, c *Conn) error) error {
+	attempts := max(s.policy.Attempts, 1)
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if s.OnRetry != nil {
+				s.OnRetry(attempt-1, err)
+			}
+
+			select {
+			case <-time.After(s.policy.backoff(attempt - 1)):
+			case <-ctx.Done():
+				return fmt.Errorf("%w after %d attempts, last error: %w", ctx.Err(), attempt-1, err)
+			}
+		}
+
+		var conn *Conn
+		conn, err = s.connect(ctx)
+		if err == nil {
+			err = op(ctx, conn)
+			if err == nil {
+				return nil
+			} else if isRetryable(ctx, err) || isSourceError(err) || conn.brokenErr() != nil {
+				// the connection may be desynchronized: start over
+				s.Close()
+			}
+		}
+
+		if !isRetryable(ctx, err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("giving up on %s after %d attempts: %w", s.address, attempts, err)
+}
+
+// isRetryable tells whether `err` may be fixed by reconnecting, i.e. whether
+// it comes from the network or from a desynchronized stream. The Merlin
+// answering an error status will answer the same, except on a corrupted
+// upload.
+func isRetryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return errors.Is(err, ErrShaInvalid)
+	}
+
+	if isSourceError(err) || errors.Is(err, ErrFrameEmpty) || errors.Is(err, ErrFrameTooLarge) {
+		return false
+	} else if errors.Is(err, ErrConnBroken) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, ErrFrameTruncated) ||
+		errors.Is(err, ErrFrameCorrupted)
+}
+
+// sourceError is an error of the reader of an upload, which reconnecting
+// does not fix.
+type sourceError struct {
+	err error
+}
+
+func (e *sourceError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sourceError) Unwrap() error {
+	return e.err
+}
+
+func isSourceError(err error) bool {
+	var srcErr *sourceError
+	return errors.As(err, &srcErr)
+}
+
+type sourceReader struct {
+	r io.Reader
+}
+
+func (r sourceReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if err != nil && err != io.EOF {
+		err = &sourceError{err}
+	}
+	return n, err
+}
+
+func (s *Session) UploadLocaFile(ctx context.Context, fileName string, localFilePath string) error {
+	fh, err := os.Open(localFilePath)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	return s.UploadReadSeeker(ctx, fileName, fh)
+}
+
+// UploadReadSeeker uploads `fh` as `fileName`. After a failed attempt, the
+// file is only sent again if the Merlin does not already have it with the
+// same size and SHA256.
+func (s *Session) UploadReadSeeker(ctx context.Context, fileName string, fh io.ReadSeeker) error {
+	size, checksum, err := hashReadSeeker(fh)
+	if err != nil {
+		return err
+	}
+
+	var retried bool
+	return s.Do(ctx, func(ctx context.Context, c *Conn) error {
+		if retried {
+			// hashing a large file takes the Merlin long: only one of the
+			// same size is hashed
+			idx, fi, err := c.lookupFile(ctx, fileName)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			} else if err == nil && fi.Size == size {
+				fi, err := c.GetFileInformationContext(ctx, idx, true)
+				if err != nil {
+					return err
+				} else if bytes.Equal(fi.Sha256, checksum) {
+					return nil
+				}
+			}
+
+			if _, err := fh.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		retried = true
+
+		return c.UploadFileReaderContext(ctx, fileName, fh, size, checksum)
+	})
+}
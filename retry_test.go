@@ -0,0 +1,147 @@
+package pinpin_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+func newSimSession(t *testing.T, opts ...pinpin.Option) (*sim.Device, *pinpin.Session, *int) {
+	t.Helper()
+
+	device, address := simtest.Serve(t)
+	session := pinpin.NewSession(address, pinpin.RetryPolicy{
+		Attempts:    3,
+		Backoff:     time.Millisecond,
+		DialTimeout: time.Second,
+	}, opts...)
+	t.Cleanup(func() { session.Close() })
+
+	retries := new(int)
+	session.OnRetry = func(int, error) { *retries++ }
+	return device, session, retries
+}
+
+func TestSessionPermanentErrors(t *testing.T) {
+	_, session, retries := newSimSession(t)
+	ctx := context.Background()
+
+	// the upload command does not fit in a frame
+	err := session.UploadReadSeeker(ctx, strings.Repeat("a", 230), bytes.NewReader([]byte("mp3")))
+	require.ErrorIs(t, err, pinpin.ErrFrameTooLarge)
+	require.Zero(t, *retries)
+
+	// the local file cannot be read
+	err = session.UploadReadSeeker(ctx, "story.mp3", failingReadSeeker{})
+	require.Error(t, err)
+	require.Zero(t, *retries)
+
+	err = session.Do(ctx, func(ctx context.Context, c *pinpin.Conn) error {
+		return c.UploadFileReaderContext(ctx, "story.mp3", failingReadSeeker{}, 3, make([]byte, 32))
+	})
+	require.ErrorIs(t, err, errRead)
+	require.Zero(t, *retries)
+
+	// the interrupted upload does not desynchronize the next operation
+	require.NoError(t, session.Do(ctx, func(ctx context.Context, c *pinpin.Conn) error {
+		return c.PingContext(ctx)
+	}))
+	require.Zero(t, *retries)
+}
+
+func TestSessionRetriesCorruptedUpload(t *testing.T) {
+	device, session, retries := newSimSession(t)
+	device.SetStatus(pinpin.CommandUploadFile, pinpin.StatusUploadShaInvalid)
+
+	err := session.UploadReadSeeker(context.Background(), "story.mp3", bytes.NewReader([]byte("mp3")))
+	require.ErrorIs(t, err, pinpin.ErrShaInvalid)
+	require.Equal(t, 2, *retries)
+}
+
+func TestSessionRetriedUploadHashes(t *testing.T) {
+	var trace bytes.Buffer
+	device, session, retries := newSimSession(t, pinpin.WithTraceRecorder(&trace))
+	ctx := context.Background()
+
+	// hashRequests counts the files the Merlin was asked to hash
+	hashRequests := func() (n int) {
+		records, err := pinpin.ReadTrace(bytes.NewReader(trace.Bytes()))
+		require.NoError(t, err)
+		for _, rec := range records {
+			if rec.Direction == pinpin.DirectionToDevice && rec.Command == "get_file_information" && strings.HasSuffix(rec.Msg, "01") {
+				n++
+			}
+		}
+		return
+	}
+
+	// another size: the file is sent again without being hashed
+	require.NoError(t, session.UploadReadSeeker(ctx, "story.mp3", bytes.NewReader([]byte("old"))))
+	device.SetStatus(pinpin.CommandUploadFile, pinpin.StatusUploadShaInvalid)
+	err := session.UploadReadSeeker(ctx, "story.mp3", bytes.NewReader([]byte("new mp3")))
+	require.ErrorIs(t, err, pinpin.ErrShaInvalid)
+	require.Equal(t, 2, *retries)
+	require.Zero(t, hashRequests())
+
+	// the same size: the file is hashed before being sent again
+	*retries = 0
+	err = session.UploadReadSeeker(ctx, "story.mp3", bytes.NewReader([]byte("mp3")))
+	require.ErrorIs(t, err, pinpin.ErrShaInvalid)
+	require.Equal(t, 2, *retries)
+	require.Equal(t, 2, hashRequests())
+}
+
+func TestSessionReconnectsAfterCancel(t *testing.T) {
+	_, session, retries := newSimSession(t)
+
+	data := bytes.Repeat([]byte("x"), 5<<20)
+	checksum := sha256.Sum256(data)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := session.Do(ctx, func(ctx context.Context, c *pinpin.Conn) error {
+		return c.UploadFileReaderContext(ctx, "big.mp3", &cancellingReader{bytes.NewReader(data), cancel}, uint32(len(data)), checksum[:])
+	})
+	require.ErrorIs(t, err, context.Canceled)
+
+	// the broken connection is replaced without a retry
+	require.NoError(t, session.Do(context.Background(), func(ctx context.Context, c *pinpin.Conn) error {
+		return c.PingContext(ctx)
+	}))
+	require.Zero(t, *retries)
+}
+
+func TestSessionRetriesConnection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := l.Addr().String()
+	l.Close()
+
+	session := pinpin.NewSession(address, pinpin.RetryPolicy{Attempts: 2, Backoff: time.Millisecond})
+	defer session.Close()
+
+	_, err = session.Conn(context.Background())
+	require.ErrorContains(t, err, "giving up on "+address+" after 2 attempts")
+}
+
+var errRead = errors.New("read failed")
+
+type failingReadSeeker struct{}
+
+func (failingReadSeeker) Read([]byte) (int, error) {
+	return 0, errRead
+}
+
+func (failingReadSeeker) Seek(int64, int) (int64, error) {
+	return 0, nil
+}
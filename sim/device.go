@@ -0,0 +1,349 @@
+// Package sim simulates a Merlin speaker in mode 'TRANSFERT', so the pinpin
+// client can be exercised without the hardware.
+package sim
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/gawen/pinpin"
+)
+
+const (
+	DefaultCapacity   uint32 = 1 << 31
+	maxUploadFileName        = 64
+	playlistBinPath          = "playlist.bin"
+
+	// statusGetFileFailed answers `CommandGetFile` for a missing file. The
+	// status of a device is unknown, only that it is not StatusOk.
+	statusGetFileFailed pinpin.Status = 0x01
+)
+
+type Device struct {
+	Storage  Storage
+	Capacity uint32
+	Logger   *slog.Logger
+
+	mu       sync.Mutex
+	statuses map[pinpin.Command]pinpin.Status
+}
+
+func NewDevice(storage Storage) *Device {
+	return &Device{
+		Storage:  storage,
+		Capacity: DefaultCapacity,
+		Logger:   slog.Default(),
+		statuses: make(map[pinpin.Command]pinpin.Status),
+	}
+}
+
+// SetStatus forces every following `cmd` to answer with `status`, e.g.
+// `pinpin.StatusUploadNotEnoughSpace` for `CommandUploadFile`.
+func (d *Device) SetStatus(cmd pinpin.Command, status pinpin.Status) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.statuses[cmd] = status
+}
+
+func (d *Device) ClearStatus(cmd pinpin.Command) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.statuses, cmd)
+}
+
+func (d *Device) forcedStatus(cmd pinpin.Command) (pinpin.Status, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	status, has := d.statuses[cmd]
+	return status, has
+}
+
+func (d *Device) ListenAndServe(address string) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	return d.Serve(l)
+}
+
+// Serve accepts connections on `l` until it is closed.
+func (d *Device) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			d.Logger.Debug("client connected", "address", conn.RemoteAddr())
+			if err := d.ServeConn(conn); err != nil {
+				d.Logger.Error("client failed", "address", conn.RemoteAddr(), "err", err)
+			}
+		}()
+	}
+}
+
+// ServeConn answers the commands sent on `rw` until it reaches EOF.
+func (d *Device) ServeConn(rw io.ReadWriter) error {
+	s := &session{
+		device: d,
+		rw:     rw,
+		enc:    pinpin.NewFrameEncoder(rw),
+		dec:    pinpin.NewFrameDecoder(rw),
+		log:    d.Logger,
+	}
+
+	for {
+		msg, err := s.readMsg()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+type session struct {
+	device *Device
+	rw     io.ReadWriter
+	enc    *pinpin.FrameEncoder
+	dec    *pinpin.FrameDecoder
+	log    *slog.Logger
+}
+
+func (s *session) writeMsg(msg []byte) error {
+	s.log.Debug("send", "msg", hex.EncodeToString(msg))
+	return s.enc.Encode(msg)
+}
+
+func (s *session) readMsg() ([]byte, error) {
+	msg, err := s.dec.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	s.log.Debug("recv", "msg", hex.EncodeToString(msg))
+	return msg, nil
+}
+
+func (s *session) reply(cmd pinpin.Command, status pinpin.Status, data ...byte) error {
+	return s.writeMsg(append([]byte{cmd, status}, data...))
+}
+
+func (s *session) handle(msg []byte) error {
+	cmd := msg[0]
+	switch cmd {
+	case pinpin.CommandUploadFile:
+		return s.handleUploadFile(msg)
+	case pinpin.CommandPing, pinpin.CommandEndSynchronization:
+		status, _ := s.device.forcedStatus(cmd)
+		return s.reply(cmd, status)
+	case pinpin.CommandGetSDSize:
+		out := make([]byte, 1+4)
+		out[0] = cmd
+		binary.LittleEndian.PutUint32(out[1:], s.device.Capacity)
+		return s.writeMsg(out)
+	case pinpin.CommandUpdatePlaylist:
+		return s.handleUpdatePlaylist(msg)
+	case pinpin.CommandGetNumberOfFiles:
+		names, err := s.device.Storage.List()
+		if err != nil {
+			return err
+		}
+
+		out := make([]byte, 1+2)
+		out[0] = cmd
+		binary.LittleEndian.PutUint16(out[1:], uint16(len(names)))
+		return s.writeMsg(out)
+	case pinpin.CommandGetFileInformation:
+		return s.handleGetFileInformation(msg)
+	case pinpin.CommandGetFile:
+		return s.handleGetFile(msg)
+	default:
+		return fmt.Errorf("unknown command 0x%.2x", cmd)
+	}
+}
+
+func (s *session) handleUploadFile(msg []byte) error {
+	cmd := msg[0]
+	forced, hasForced := s.device.forcedStatus(cmd)
+	if hasForced && forced != pinpin.StatusUploadShaInvalid && forced != pinpin.StatusUploadShaValid {
+		return s.reply(cmd, forced)
+	}
+
+	if len(msg) < 2 || len(msg) != 2+int(msg[1])+4+sha256.Size {
+		return s.reply(cmd, pinpin.StatusUploadBadCommandLength)
+	}
+
+	fileNameLen := int(msg[1])
+	fileName := string(msg[2 : 2+fileNameLen])
+	size := binary.LittleEndian.Uint32(msg[2+fileNameLen : 2+fileNameLen+4])
+	checksum := msg[2+fileNameLen+4:]
+
+	if fileNameLen > maxUploadFileName {
+		return s.reply(cmd, pinpin.StatusUploadFileNameTooLarge)
+	}
+
+	used, err := s.usedSpace(fileName)
+	if err != nil {
+		return err
+	} else if used+uint64(size) > uint64(s.device.Capacity) {
+		return s.reply(cmd, pinpin.StatusUploadNotEnoughSpace)
+	}
+
+	if err := s.reply(cmd, pinpin.StatusOk); err != nil {
+		return err
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(s.rw, data); err != nil {
+		return fmt.Errorf("unable to read file '%s': %w", fileName, err)
+	}
+
+	if digest := sha256.Sum256(data); !bytes.Equal(digest[:], checksum) || forced == pinpin.StatusUploadShaInvalid {
+		return s.reply(cmd, pinpin.StatusUploadShaInvalid)
+	}
+
+	if err := s.device.Storage.WriteFile(fileName, data); err != nil {
+		return fmt.Errorf("unable to store file '%s': %w", fileName, err)
+	}
+
+	return s.reply(cmd, pinpin.StatusUploadShaValid)
+}
+
+func (s *session) usedSpace(except string) (uint64, error) {
+	names, err := s.device.Storage.List()
+	if err != nil {
+		return 0, err
+	}
+
+	var used uint64
+	for _, name := range names {
+		if name == except {
+			continue
+		}
+
+		size, err := s.device.Storage.Stat(name)
+		if err != nil {
+			return 0, err
+		}
+		used += uint64(size)
+	}
+
+	return used, nil
+}
+
+func (s *session) handleGetFileInformation(msg []byte) error {
+	cmd := msg[0]
+	if status, has := s.device.forcedStatus(cmd); has {
+		return s.reply(cmd, status)
+	}
+
+	if len(msg) != 1+2+1 {
+		return fmt.Errorf("unexpected `CommandGetFileInformation` length %dB", len(msg))
+	}
+
+	idx := int(binary.LittleEndian.Uint16(msg[1:3]))
+	computeSha256 := msg[3] != 0
+
+	names, err := s.device.Storage.List()
+	if err != nil {
+		return err
+	} else if idx >= len(names) {
+		return s.reply(cmd, pinpin.StatusFileInformationBadIndex)
+	}
+
+	path := names[idx]
+	var digest [sha256.Size]byte
+	var size int64
+	if computeSha256 {
+		data, err := s.device.Storage.ReadFile(path)
+		if err != nil {
+			return s.reply(cmd, pinpin.StatusFileInformationOpenFailed)
+		}
+		size = int64(len(data))
+		digest = sha256.Sum256(data)
+	} else {
+		size, err = s.device.Storage.Stat(path)
+		if err != nil {
+			return s.reply(cmd, pinpin.StatusFileInformationOpenFailed)
+		}
+	}
+
+	out := []byte{byte(len(path))}
+	out = append(out, path...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(size))
+	out = append(out, digest[:]...)
+	return s.reply(cmd, pinpin.StatusOk, out...)
+}
+
+func (s *session) handleGetFile(msg []byte) error {
+	cmd := msg[0]
+	if status, has := s.device.forcedStatus(cmd); has {
+		return s.reply(cmd, status)
+	}
+
+	path := string(msg[1:])
+	data, err := s.device.Storage.ReadFile(path)
+	if err != nil {
+		return s.reply(cmd, statusGetFileFailed)
+	}
+
+	out := []byte{byte(len(path))}
+	out = append(out, path...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(data)))
+	if err := s.reply(cmd, pinpin.StatusOk, out...); err != nil {
+		return err
+	}
+
+	_, err = s.rw.Write(data)
+	return err
+}
+
+func (s *session) handleUpdatePlaylist(msg []byte) error {
+	cmd := msg[0]
+	if status, has := s.device.forcedStatus(cmd); has {
+		return s.reply(cmd, status)
+	}
+
+	path := string(msg[1:])
+	if len(path) == 0 {
+		return s.reply(cmd, pinpin.StatusUpdatePlaylistFileNameLength)
+	}
+
+	raw, err := s.device.Storage.ReadFile(path)
+	if err != nil {
+		return s.reply(cmd, pinpin.StatusUpdatePlaylistOpenJson)
+	}
+
+	playlistBin, status := convertPlaylist(raw, s.device.Storage)
+	if status != pinpin.StatusOk {
+		return s.reply(cmd, status)
+	}
+
+	if err := s.device.Storage.WriteFile(playlistBinPath, playlistBin); err != nil {
+		return s.reply(cmd, pinpin.StatusUpdatePlaylistOpenBinary)
+	}
+
+	return s.reply(cmd, pinpin.StatusOk)
+}
@@ -0,0 +1,158 @@
+package sim_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeviceFiles(t *testing.T) {
+	_, c := simtest.Dial(t)
+
+	require.NoError(t, c.Ping())
+
+	size, err := c.GetSDSize()
+	require.NoError(t, err)
+	require.Equal(t, sim.DefaultCapacity, size)
+
+	data := bytes.Repeat([]byte("pinpin"), 10000)
+	require.NoError(t, c.UploadBytes("story.mp3", data))
+
+	count, err := c.GetNumberOfFiles()
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), count)
+
+	fi, err := c.LookupFileInformation("story.mp3", true)
+	require.NoError(t, err)
+	require.Equal(t, uint32(len(data)), fi.Size)
+	checksum := sha256.Sum256(data)
+	require.Equal(t, checksum[:], fi.Sha256)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.GetFile("story.mp3", &buf))
+	require.Equal(t, data, buf.Bytes())
+
+	var statusErr *pinpin.StatusError
+	require.ErrorAs(t, c.GetFile("missing.mp3", new(bytes.Buffer)), &statusErr)
+	require.Equal(t, pinpin.CommandGetFile, statusErr.Command)
+
+	// the connection is still in sync after the raw file data
+	require.NoError(t, c.Ping())
+}
+
+func TestDeviceUpdatePlaylist(t *testing.T) {
+	_, c := simtest.Dial(t)
+
+	folder := "11111111-1111-1111-1111-111111111111"
+	story := "22222222-2222-2222-2222-222222222222"
+	require.NoError(t, c.UploadBytes(folder+".jpg", []byte("jpeg")))
+	require.NoError(t, c.UploadBytes(story+".mp3", []byte("mp3")))
+
+	raw, err := json.Marshal([]*pinpin.PlaylistTreeNode{{
+		UUID:  folder,
+		Title: "Contes",
+		Children: []*pinpin.PlaylistTreeNode{{
+			UUID:        story,
+			Title:       "Le loup",
+			AddTimeUnix: 1700000000,
+		}},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, c.UploadBytes("playlist.json", raw))
+	require.NoError(t, c.UpdatePlaylist("playlist.json"))
+
+	var buf bytes.Buffer
+	require.NoError(t, c.GetFile("playlist.bin", &buf))
+	items, err := pinpin.DecodePlaylistBin(buf.Bytes())
+	require.NoError(t, err)
+	require.Empty(t, pinpin.ValidatePlaylist(items))
+
+	nodes, err := pinpin.BuildPlaylistTree(items)
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	require.Equal(t, folder, nodes[0].UUID)
+	require.Len(t, nodes[0].Children, 1)
+	require.Equal(t, story, nodes[0].Children[0].UUID)
+	require.Equal(t, "Le loup", nodes[0].Children[0].Title)
+
+	// a story without its audio is refused
+	raw, err = json.Marshal([]*pinpin.PlaylistTreeNode{{
+		UUID:     folder,
+		Title:    "Contes",
+		Children: []*pinpin.PlaylistTreeNode{{UUID: "missing", Title: "Missing"}},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, c.UploadBytes("playlist.json", raw))
+	require.ErrorIs(t, c.UpdatePlaylist("playlist.json"), pinpin.ErrMusicMp3NotFound)
+}
+
+func TestDeviceManyFavorites(t *testing.T) {
+	_, c := simtest.Dial(t)
+
+	// the limit on favorites was never observed on a device
+	folder := &pinpin.PlaylistTreeNode{UUID: "folder", Title: "Contes", Children: []*pinpin.PlaylistTreeNode{}}
+	require.NoError(t, c.UploadBytes("folder.jpg", []byte("jpeg")))
+	for idx := range pinpin.PlaylistMaxFavorites + 1 {
+		uuid := fmt.Sprintf("story-%d", idx)
+		require.NoError(t, c.UploadBytes(uuid+".mp3", []byte("mp3")))
+		folder.Children = append(folder.Children, &pinpin.PlaylistTreeNode{UUID: uuid, Title: uuid, Favorite: 1})
+	}
+
+	raw, err := pinpin.MarshalPlaylistJson([]*pinpin.PlaylistTreeNode{folder})
+	require.NoError(t, err)
+	require.NoError(t, c.UploadBytes("playlist.json", raw))
+	require.NoError(t, c.UpdatePlaylist("playlist.json"))
+}
+
+func TestDeviceStatuses(t *testing.T) {
+	device, c := simtest.Dial(t)
+
+	require.NoError(t, c.UploadBytes("story.mp3", []byte("mp3")))
+
+	for _, tc := range []struct {
+		cmd    pinpin.Command
+		status pinpin.Status
+		err    error
+		call   func() error
+	}{
+		{pinpin.CommandUploadFile, pinpin.StatusUploadNotEnoughSpace, pinpin.ErrNotEnoughSpace, func() error {
+			return c.UploadBytes("other.mp3", []byte("mp3"))
+		}},
+		{pinpin.CommandUploadFile, pinpin.StatusUploadFileNameTooLarge, pinpin.ErrFileNameTooLarge, func() error {
+			return c.UploadBytes("other.mp3", []byte("mp3"))
+		}},
+		{pinpin.CommandUploadFile, pinpin.StatusUploadShaInvalid, pinpin.ErrShaInvalid, func() error {
+			return c.UploadBytes("other.mp3", []byte("mp3"))
+		}},
+		{pinpin.CommandGetFileInformation, pinpin.StatusFileInformationOpenFailed, pinpin.ErrOpenFile, func() error {
+			_, err := c.GetFileInformation(0, true)
+			return err
+		}},
+		{pinpin.CommandUpdatePlaylist, pinpin.StatusUpdatePlaylistTooManyFavorite, pinpin.ErrTooManyFavorite, func() error {
+			return c.UpdatePlaylist("playlist.json")
+		}},
+	} {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			device.SetStatus(tc.cmd, tc.status)
+			defer device.ClearStatus(tc.cmd)
+
+			err := tc.call()
+			require.ErrorIs(t, err, tc.err)
+
+			var statusErr *pinpin.StatusError
+			require.True(t, errors.As(err, &statusErr))
+			require.Equal(t, tc.status, statusErr.Code)
+		})
+	}
+
+	// the connection survives the error statuses
+	require.NoError(t, c.Ping())
+}
@@ -0,0 +1,78 @@
+package sim
+
+import (
+	"encoding/json"
+
+	"github.com/gawen/pinpin"
+)
+
+// convertPlaylist mimics the firmware's conversion of `playlist.json` into
+// `playlist.bin`. It returns the `CommandUpdatePlaylist` status on failure.
+func convertPlaylist(raw []byte, storage Storage) ([]byte, pinpin.Status) {
+	var rawNodes []json.RawMessage
+	if !json.Valid(raw) {
+		return nil, pinpin.StatusUpdatePlaylistMinifyJson
+	} else if err := json.Unmarshal(raw, &rawNodes); err != nil {
+		return nil, pinpin.StatusUpdatePlaylistRootNotArray
+	} else if len(rawNodes) == 0 {
+		return nil, pinpin.StatusUpdatePlaylistMinRootSize
+	}
+
+	nodes, err := pinpin.UnmarshalPlaylistJson(raw)
+	if err != nil {
+		return nil, pinpin.StatusUpdatePlaylistInvalidType
+	}
+
+	if status := checkPlaylistFiles(nodes, storage); status != pinpin.StatusOk {
+		return nil, status
+	}
+
+	items, err := pinpin.FlattenPlaylistTree(nodes)
+	if err != nil {
+		return nil, pinpin.StatusUpdatePlaylistInvalidType
+	}
+
+	for idx := range items {
+		items[idx].FileName = truncate(items[idx].FileName, pinpin.PlaylistFileNameMaxLen)
+		items[idx].Title = truncate(items[idx].Title, pinpin.PlaylistTitleMaxLen)
+	}
+
+	buf, err := pinpin.EncodePlaylistBin(items)
+	if err != nil {
+		return nil, pinpin.StatusUpdatePlaylistInvalidType
+	}
+
+	return buf, pinpin.StatusOk
+}
+
+// checkPlaylistFiles checks the image of every folder and the audio of every
+// track are on the SD card.
+func checkPlaylistFiles(nodes []*pinpin.PlaylistTreeNode, storage Storage) pinpin.Status {
+	for _, node := range nodes {
+		if node == nil {
+			return pinpin.StatusUpdatePlaylistInvalidType
+		}
+
+		if node.Children != nil {
+			if _, err := storage.Stat(node.UUID + ".jpg"); err != nil {
+				return pinpin.StatusUpdatePlaylistCategoryJpegNotFound
+			}
+		} else if _, err := storage.Stat(node.UUID + ".mp3"); err != nil {
+			return pinpin.StatusUpdatePlaylistMusicNotFound
+		}
+
+		if status := checkPlaylistFiles(node.Children, storage); status != pinpin.StatusOk {
+			return status
+		}
+	}
+
+	return pinpin.StatusOk
+}
+
+// truncate cuts `s` to `size` bytes, like the firmware's fixed-size fields.
+func truncate(s string, size int) string {
+	if len(s) > size {
+		return s[:size]
+	}
+	return s
+}
@@ -0,0 +1,42 @@
+// Package simtest serves simulated Merlins to the tests.
+package simtest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim"
+)
+
+// Serve serves a simulated Merlin, with an in-memory SD card, on a local port
+// until the end of the test. It returns the device and its address.
+func Serve(t testing.TB) (*sim.Device, string) {
+	t.Helper()
+
+	device := sim.NewDevice(sim.NewMemoryStorage())
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go device.Serve(l)
+
+	return device, l.Addr().String()
+}
+
+// Dial is Serve, also returning a connection to the device closed at the end
+// of the test.
+func Dial(t testing.TB, opts ...pinpin.Option) (*sim.Device, *pinpin.Conn) {
+	t.Helper()
+
+	device, address := Serve(t)
+	c, err := pinpin.DialTimeout(address, 5*time.Second, opts...)
+	if err != nil {
+		t.Fatalf("unable to connect to the simulator: %s", err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return device, c
+}
@@ -0,0 +1,159 @@
+package sim
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sync"
+)
+
+// Storage is the SD card of a simulated Merlin. File names are flat: the
+// device has no notion of directories.
+type Storage interface {
+	List() ([]string, error)
+	Stat(name string) (int64, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte) error
+}
+
+type MemoryStorage struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		files: make(map[string][]byte),
+	}
+}
+
+func (s *MemoryStorage) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	names := make([]string, 0, len(s.files))
+	for name := range s.files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	return names, nil
+}
+
+func (s *MemoryStorage) Stat(name string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, has := s.files[name]
+	if !has {
+		return 0, fs.ErrNotExist
+	}
+
+	return int64(len(data)), nil
+}
+
+func (s *MemoryStorage) ReadFile(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, has := s.files[name]
+	if !has {
+		return nil, fs.ErrNotExist
+	}
+
+	return slices.Clone(data), nil
+}
+
+func (s *MemoryStorage) WriteFile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.files[name] = slices.Clone(data)
+	return nil
+}
+
+// DirStorage backs the SD card with a directory of the local filesystem.
+type DirStorage struct {
+	root *os.Root
+}
+
+func NewDirStorage(path string) (*DirStorage, error) {
+	root, err := os.OpenRoot(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DirStorage{
+		root: root,
+	}, nil
+}
+
+func (s *DirStorage) Close() error {
+	return s.root.Close()
+}
+
+func (s *DirStorage) List() ([]string, error) {
+	dir, err := s.root.Open(".")
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	entries, err := dir.ReadDir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	slices.Sort(names)
+
+	return names, nil
+}
+
+func (s *DirStorage) Stat(name string) (int64, error) {
+	fi, err := s.root.Stat(name)
+	if err != nil {
+		return 0, err
+	} else if !fi.Mode().IsRegular() {
+		return 0, fs.ErrNotExist
+	}
+
+	return fi.Size(), nil
+}
+
+func (s *DirStorage) ReadFile(name string) ([]byte, error) {
+	fh, err := s.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	} else if !fi.Mode().IsRegular() {
+		return nil, fs.ErrNotExist
+	}
+
+	return io.ReadAll(fh)
+}
+
+func (s *DirStorage) WriteFile(name string, data []byte) error {
+	fh, err := s.root.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fh.Write(data); err != nil {
+		fh.Close()
+		return err
+	}
+
+	return fh.Close()
+}
@@ -0,0 +1,142 @@
+package pinpin
+
+import (
+	"fmt"
+	"os"
+)
+
+type Status = byte
+
+const StatusOk Status = 0x00
+
+// `CommandUploadFile` statuses
+const (
+	StatusUploadShaValid         Status = 0x01
+	StatusUploadNotEnoughSpace   Status = 0x02
+	StatusUploadFileNameTooLarge Status = 0x03
+	StatusUploadShaInvalid       Status = 0x04
+	StatusUploadBadCommandLength Status = 0x05
+	StatusUploadFailOpenFile     Status = 0x07
+)
+
+// `CommandGetFileInformation` statuses
+const (
+	StatusFileInformationBadIndex   Status = 0x02
+	StatusFileInformationExist      Status = 0x03
+	StatusFileInformationOpenFailed Status = 0x04
+)
+
+// `CommandGetFile` has no documented error status: any but StatusOk fails
+// with a *StatusError.
+
+// `CommandUpdatePlaylist` statuses
+const (
+	StatusUpdatePlaylistFileNameLength       Status = 0x01
+	StatusUpdatePlaylistMinifyJson           Status = 0x04
+	StatusUpdatePlaylistOpenJson             Status = 0x05
+	StatusUpdatePlaylistOpenBinary           Status = 0x06
+	StatusUpdatePlaylistRootNotArray         Status = 0x07
+	StatusUpdatePlaylistMinRootSize          Status = 0x08
+	StatusUpdatePlaylistRenameTmp            Status = 0x0f
+	StatusUpdatePlaylistInvalidType          Status = 0x10
+	StatusUpdatePlaylistCategoryJpegNotFound Status = 0x11
+	StatusUpdatePlaylistMusicNotFound        Status = 0x12
+	StatusUpdatePlaylistFavoriteNotFound     Status = 0x13
+	StatusUpdatePlaylistTooManyFavorite      Status = 0x14
+	StatusUpdatePlaylistCreateFavorite       Status = 0x15
+	StatusUpdatePlaylistReadLstFav           Status = 0x16
+	StatusUpdatePlaylistUnableReadLstFav     Status = 0x17
+	StatusUpdatePlaylistOpenSdcardDir        Status = 0x18
+)
+
+// StatusError is returned when the Merlin answers a command with an error
+// status. Compare it to the `Err...` sentinels with `errors.Is`.
+type StatusError struct {
+	Command Command
+	Code    Status
+}
+
+var (
+	ErrNotEnoughSpace       = &StatusError{CommandUploadFile, StatusUploadNotEnoughSpace}
+	ErrFileNameTooLarge     = &StatusError{CommandUploadFile, StatusUploadFileNameTooLarge}
+	ErrShaInvalid           = &StatusError{CommandUploadFile, StatusUploadShaInvalid}
+	ErrBadCommandLength     = &StatusError{CommandUploadFile, StatusUploadBadCommandLength}
+	ErrFailOpenUploadFile   = &StatusError{CommandUploadFile, StatusUploadFailOpenFile}
+	ErrBadFileIndex         = &StatusError{CommandGetFileInformation, StatusFileInformationBadIndex}
+	ErrFileExist            = &StatusError{CommandGetFileInformation, StatusFileInformationExist}
+	ErrOpenFile             = &StatusError{CommandGetFileInformation, StatusFileInformationOpenFailed}
+	ErrFileNameLength       = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistFileNameLength}
+	ErrMinifyJson           = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistMinifyJson}
+	ErrOpenJson             = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistOpenJson}
+	ErrOpenPlaylistBinary   = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistOpenBinary}
+	ErrJsonRootNotArray     = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistRootNotArray}
+	ErrMinRootCategorySize  = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistMinRootSize}
+	ErrRenameBinaryTmp      = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistRenameTmp}
+	ErrInvalidType          = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistInvalidType}
+	ErrCategoryJpegNotFound = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistCategoryJpegNotFound}
+	ErrMusicMp3NotFound     = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistMusicNotFound}
+	ErrFavoriteNotFound     = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistFavoriteNotFound}
+	ErrTooManyFavorite      = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistTooManyFavorite}
+	ErrCreateFavoriteFile   = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistCreateFavorite}
+	ErrReadLstFavFile       = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistReadLstFav}
+	ErrUnableReadLstFavFile = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistUnableReadLstFav}
+	ErrOpenSdcardDir        = &StatusError{CommandUpdatePlaylist, StatusUpdatePlaylistOpenSdcardDir}
+)
+
+var statusMessages = map[StatusError]string{
+	*ErrNotEnoughSpace:       "not enough space",
+	*ErrFileNameTooLarge:     "filename too large",
+	*ErrShaInvalid:           "sha invalid",
+	*ErrBadCommandLength:     "bad command length",
+	*ErrFailOpenUploadFile:   "fail open upload file",
+	*ErrBadFileIndex:         "bad file index",
+	*ErrFileExist:            "file exists",
+	*ErrOpenFile:             "unable to open file",
+	*ErrFileNameLength:       "invalid minimum length of filename",
+	*ErrMinifyJson:           "failed to minifier the JSON file",
+	*ErrOpenJson:             "failed open JSON file",
+	*ErrOpenPlaylistBinary:   "failed to open playlist binary file",
+	*ErrJsonRootNotArray:     "JSON root element is not an array",
+	*ErrMinRootCategorySize:  "min root category size is invalid",
+	*ErrRenameBinaryTmp:      "failed to rename binary tmp file",
+	*ErrInvalidType:          "invalid type found in binary file",
+	*ErrCategoryJpegNotFound: "category JPEG not found",
+	*ErrMusicMp3NotFound:     "music mp32 not found",
+	*ErrFavoriteNotFound:     "favorite not found",
+	*ErrTooManyFavorite:      "too many favorite",
+	*ErrCreateFavoriteFile:   "failed to create favorite file",
+	*ErrReadLstFavFile:       "failed to read lst fav file",
+	*ErrUnableReadLstFavFile: "unable to read lst fav file",
+	*ErrOpenSdcardDir:        "failed to open sdcard dir",
+}
+
+func (e *StatusError) Error() string {
+	if msg, has := statusMessages[*e]; has {
+		return msg
+	}
+
+	return fmt.Sprintf("unexpected command 0x%.2x status: 0x%.2x", e.Command, e.Code)
+}
+
+func (e *StatusError) Is(target error) bool {
+	t, ok := target.(*StatusError)
+	return ok && *t == *e
+}
+
+func (e *StatusError) Unwrap() error {
+	if *e == *ErrFileExist {
+		// kept for callers comparing to `os.ErrExist`
+		return os.ErrExist
+	}
+
+	return nil
+}
+
+// checkResponse returns an error if `out` is shorter than `size` bytes.
+func checkResponse(cmd Command, out []byte, size int) error {
+	if len(out) < size {
+		return fmt.Errorf("unexpected command 0x%.2x response of %dB, expected at least %dB", cmd, len(out), size)
+	}
+
+	return nil
+}
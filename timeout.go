@@ -0,0 +1,101 @@
+package pinpin
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// WithIOTimeout fails an exchange if the Merlin does not let a read or a write
+// progress for `timeout`, however long the whole exchange, such as a file
+// transfer, takes. It does not apply to the SHA256 of GetFileInformation,
+// which the Merlin computes for long without a word on a large file. The
+// transport must support deadlines, like `net.Conn`; otherwise the option has
+// no effect.
+func WithIOTimeout(timeout time.Duration) Option {
+	return func(c *Conn) {
+		if timeout <= 0 {
+			return
+		}
+
+		// a wrapper, such as a TraceRecorder, may not support deadlines
+		// whatever its methods
+		d, ok := c.conn.(deadliner)
+		if !ok {
+			return
+		} else if err := d.SetDeadline(time.Time{}); errors.Is(err, errors.ErrUnsupported) {
+			return
+		}
+
+		c.ioTimeout = &ioTimeoutConn{
+			rw:      c.conn,
+			timeout: timeout,
+		}
+		c.conn = c.ioTimeout
+	}
+}
+
+// ioTimeoutConn moves the deadline of the transport before each read and
+// write, without going past the deadline set by the exchange.
+type ioTimeoutConn struct {
+	rw      io.ReadWriteCloser
+	timeout time.Duration
+
+	// mu orders the deadline updates, so an interruption is not overridden
+	mu       sync.Mutex
+	deadline time.Time
+	// paused leaves only the deadline set by the exchange
+	paused bool
+}
+
+func (c *ioTimeoutConn) extend() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deadline := time.Now().Add(c.timeout)
+	if c.paused || (!c.deadline.IsZero() && c.deadline.Before(deadline)) {
+		deadline = c.deadline
+	}
+	return c.rw.(deadliner).SetDeadline(deadline)
+}
+
+// pause stops the timeout until `resume` is called.
+func (c *ioTimeoutConn) pause() (resume func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.paused = true
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		c.paused = false
+	}
+}
+
+func (c *ioTimeoutConn) Read(b []byte) (int, error) {
+	if err := c.extend(); err != nil {
+		return 0, err
+	}
+	return c.rw.Read(b)
+}
+
+func (c *ioTimeoutConn) Write(b []byte) (int, error) {
+	if err := c.extend(); err != nil {
+		return 0, err
+	}
+	return c.rw.Write(b)
+}
+
+func (c *ioTimeoutConn) Close() error {
+	return c.rw.Close()
+}
+
+func (c *ioTimeoutConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return c.rw.(deadliner).SetDeadline(t)
+}
@@ -0,0 +1,82 @@
+package pinpin_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIOTimeoutTraceRecorder(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go sim.NewDevice(sim.NewMemoryStorage()).ServeConn(server)
+
+	// a transport without deadlines
+	plain := struct{ io.ReadWriteCloser }{client}
+
+	var trace bytes.Buffer
+	c := pinpin.NewConn(plain, pinpin.WithTraceRecorder(&trace), pinpin.WithIOTimeout(time.Second))
+	require.NoError(t, c.Ping())
+	require.NoError(t, c.Close())
+
+	records, err := pinpin.ReadTrace(&trace)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+}
+
+func TestIOTimeoutTraceRecorderDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// the Merlin never answers
+	go io.Copy(io.Discard, server)
+
+	var trace bytes.Buffer
+	c := pinpin.NewConn(client, pinpin.WithTraceRecorder(&trace), pinpin.WithIOTimeout(10*time.Millisecond))
+	defer c.Close()
+	require.ErrorIs(t, c.Ping(), os.ErrDeadlineExceeded)
+}
+
+func TestIOTimeoutHash(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	// the Merlin answers file information after a long silence
+	go func() {
+		dec, enc := pinpin.NewFrameDecoder(server), pinpin.NewFrameEncoder(server)
+		for {
+			if _, err := dec.Decode(); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+
+			out := []byte{pinpin.CommandGetFileInformation, pinpin.StatusOk, byte(len("story.mp3"))}
+			out = append(out, "story.mp3"...)
+			out = binary.LittleEndian.AppendUint32(out, 3)
+			out = append(out, make([]byte, sha256.Size)...)
+			if err := enc.Encode(out); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := pinpin.NewConn(client, pinpin.WithIOTimeout(10*time.Millisecond))
+	defer c.Close()
+
+	// hashing a file is expected to take long
+	fi, err := c.GetFileInformation(0, true)
+	require.NoError(t, err)
+	require.Equal(t, "story.mp3", fi.Path)
+
+	_, err = c.GetFileInformation(0, false)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+}
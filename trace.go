@@ -0,0 +1,198 @@
+package pinpin
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TraceRecord is a segment of a recorded exchange, one per line of a JSONL
+// trace file.
+type TraceRecord struct {
+	Time      time.Time `json:"time"`
+	Direction Direction `json:"dir"`
+	Frame     bool      `json:"frame"`
+	Command   string    `json:"command,omitempty"`
+	Status    *Status   `json:"status,omitempty"`
+	Msg       string    `json:"msg,omitempty"`
+	Raw       string    `json:"raw"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// NewTraceRecord describes `seg`, seen at `t`.
+func NewTraceRecord(t time.Time, seg Segment) TraceRecord {
+	rec := TraceRecord{
+		Time:      t,
+		Direction: seg.Direction,
+		Frame:     seg.Frame,
+		Raw:       hex.EncodeToString(seg.Raw),
+	}
+	rec.Command, _ = CommandName(seg.Command)
+	if status, has := seg.Status(); has {
+		rec.Status = &status
+	}
+	if seg.Msg != nil {
+		rec.Msg = hex.EncodeToString(seg.Msg)
+	}
+	if seg.Err != nil {
+		rec.Error = seg.Err.Error()
+	}
+	return rec
+}
+
+// TraceRecorder wraps a transport and records every segment exchanged on it
+// as JSONL.
+type TraceRecorder struct {
+	rw        io.ReadWriteCloser
+	mu        sync.Mutex
+	enc       *json.Encoder
+	dissector *Dissector
+	err       error
+}
+
+func NewTraceRecorder(rw io.ReadWriteCloser, w io.Writer) *TraceRecorder {
+	return &TraceRecorder{
+		rw:        rw,
+		enc:       json.NewEncoder(w),
+		dissector: NewDissector(),
+	}
+}
+
+// WithTraceRecorder records the exchanges of the Conn to `w`.
+func WithTraceRecorder(w io.Writer) Option {
+	return func(c *Conn) {
+		c.conn = NewTraceRecorder(c.conn, w)
+	}
+}
+
+func (r *TraceRecorder) record(segs []Segment) {
+	now := time.Now()
+	for _, seg := range segs {
+		if r.err != nil {
+			return
+		}
+		r.err = r.enc.Encode(NewTraceRecord(now, seg))
+	}
+}
+
+func (r *TraceRecorder) Read(b []byte) (int, error) {
+	n, err := r.rw.Read(b)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(r.dissector.Feed(DirectionFromDevice, b[:n]))
+
+	return n, err
+}
+
+func (r *TraceRecorder) Write(b []byte) (int, error) {
+	n, err := r.rw.Write(b)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.record(r.dissector.Feed(DirectionToDevice, b[:n]))
+
+	return n, err
+}
+
+func (r *TraceRecorder) Close() error {
+	r.mu.Lock()
+	r.record(r.dissector.Flush())
+	r.mu.Unlock()
+
+	return r.rw.Close()
+}
+
+func (r *TraceRecorder) SetDeadline(t time.Time) error {
+	if d, ok := r.rw.(deadliner); ok {
+		return d.SetDeadline(t)
+	}
+
+	return errors.ErrUnsupported
+}
+
+// Err returns the first error met while writing the trace.
+func (r *TraceRecorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+func ReadTrace(r io.Reader) ([]TraceRecord, error) {
+	var records []TraceRecord
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	for lineIdx := 1; scanner.Scan(); lineIdx++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+
+		var rec TraceRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineIdx, err)
+		}
+		records = append(records, rec)
+	}
+
+	return records, scanner.Err()
+}
+
+// TraceReplayer plays the Merlin's side of a recorded trace, to reproduce an
+// exchange without the hardware.
+type TraceReplayer struct {
+	records []TraceRecord
+}
+
+func NewTraceReplayer(records []TraceRecord) *TraceReplayer {
+	return &TraceReplayer{
+		records: records,
+	}
+}
+
+// Serve replays the trace on `rw`: it checks the client sends exactly the
+// recorded bytes and answers the recorded ones.
+func (r *TraceReplayer) Serve(rw io.ReadWriter) error {
+	for recIdx, rec := range r.records {
+		raw, err := hex.DecodeString(rec.Raw)
+		if err != nil {
+			return fmt.Errorf("record #%d: %w", recIdx, err)
+		}
+
+		if rec.Direction == DirectionFromDevice {
+			if _, err := rw.Write(raw); err != nil {
+				return fmt.Errorf("record #%d: unable to write: %w", recIdx, err)
+			}
+			continue
+		}
+
+		got := make([]byte, len(raw))
+		if _, err := io.ReadFull(rw, got); err != nil {
+			return fmt.Errorf("record #%d: unable to read: %w", recIdx, err)
+		} else if !bytes.Equal(got, raw) {
+			return fmt.Errorf("record #%d: expected %s, got %s", recIdx, rec.Raw, hex.EncodeToString(got))
+		}
+	}
+
+	return nil
+}
+
+// Pipe starts replaying the trace and returns the client's end of it. The
+// outcome of the replay is sent on the returned channel.
+func (r *TraceReplayer) Pipe() (net.Conn, <-chan error) {
+	client, device := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer device.Close()
+		done <- r.Serve(device)
+	}()
+	return client, done
+}
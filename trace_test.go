@@ -0,0 +1,81 @@
+package pinpin_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gawen/pinpin"
+	"github.com/gawen/pinpin/sim/simtest"
+	"github.com/stretchr/testify/require"
+)
+
+// exchange runs operations covering frames and raw file data.
+func exchange(t *testing.T, c *pinpin.Conn) {
+	t.Helper()
+
+	require.NoError(t, c.Ping())
+	require.NoError(t, c.UploadBytes("story.mp3", []byte("pinpin")))
+
+	fi, err := c.LookupFileInformation("story.mp3", true)
+	require.NoError(t, err)
+	require.Equal(t, uint32(6), fi.Size)
+
+	var buf bytes.Buffer
+	require.NoError(t, c.GetFile("story.mp3", &buf))
+	require.Equal(t, "pinpin", buf.String())
+
+	var statusErr *pinpin.StatusError
+	require.ErrorAs(t, c.GetFile("missing.mp3", new(bytes.Buffer)), &statusErr)
+	require.Equal(t, pinpin.CommandGetFile, statusErr.Command)
+}
+
+// recordTrace runs `exchange` against the simulator and returns its trace.
+func recordTrace(t *testing.T) []pinpin.TraceRecord {
+	t.Helper()
+
+	var trace bytes.Buffer
+	_, c := simtest.Dial(t, pinpin.WithTraceRecorder(&trace))
+	exchange(t, c)
+	require.NoError(t, c.Close())
+
+	records, err := pinpin.ReadTrace(&trace)
+	require.NoError(t, err)
+	return records
+}
+
+func TestTraceReplay(t *testing.T) {
+	records := recordTrace(t)
+	require.NotEmpty(t, records)
+
+	// the file data is recorded apart from the frames
+	var hasRaw bool
+	for _, rec := range records {
+		hasRaw = hasRaw || !rec.Frame
+		require.Empty(t, rec.Error)
+	}
+	require.True(t, hasRaw)
+
+	pipe, done := pinpin.NewTraceReplayer(records).Pipe()
+	c := pinpin.NewConn(pipe)
+	exchange(t, c)
+	require.NoError(t, <-done)
+	require.NoError(t, c.Close())
+}
+
+func TestTraceReplayMismatch(t *testing.T) {
+	records := recordTrace(t)
+
+	pipe, done := pinpin.NewTraceReplayer(records).Pipe()
+	c := pinpin.NewConn(pipe)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the trace starts with a ping
+	_, err := c.GetSDSizeContext(ctx)
+	require.Error(t, err)
+	require.ErrorContains(t, <-done, "record #0: expected")
+}
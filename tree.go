@@ -0,0 +1,262 @@
+package pinpin
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+var (
+	ErrPlaylistNotFolder = errors.New("not a folder")
+	ErrPlaylistNotTrack  = errors.New("not a track")
+)
+
+// PlaylistTree is the top-level nodes of a playlist, with methods to edit it.
+// Nodes are designated by their UUID, which is unique in a playlist.
+type PlaylistTree []*PlaylistTreeNode
+
+// Find returns the node of UUID `uuid`, or nil.
+func (t PlaylistTree) Find(uuid string) (node *PlaylistTreeNode) {
+	walkPlaylistTree(t, func(n *PlaylistTreeNode) {
+		if node == nil && n.UUID == uuid {
+			node = n
+		}
+	})
+	return
+}
+
+// Lookup returns the node at `path`, the titles of the nodes from the top
+// separated by slashes, such as "/Stories/The Three Little Pigs". If several
+// siblings have the same title, the first one is taken. The root, "/", is a
+// folder of empty UUID, the one designating the top-level, holding the
+// top-level nodes.
+func (t PlaylistTree) Lookup(path string) (*PlaylistTreeNode, error) {
+	nodes := []*PlaylistTreeNode(t)
+
+	trimmed := strings.Trim(path, "/")
+	if trimmed == "" {
+		return &PlaylistTreeNode{Children: append([]*PlaylistTreeNode{}, nodes...)}, nil
+	}
+
+	var node *PlaylistTreeNode
+	for _, title := range strings.Split(trimmed, "/") {
+		if node != nil && node.Children == nil {
+			return nil, fmt.Errorf("'%s': '%s' %w", path, node.Title, ErrPlaylistNotFolder)
+		}
+
+		idx := slices.IndexFunc(nodes, func(n *PlaylistTreeNode) bool {
+			return n.Title == title
+		})
+		if idx < 0 {
+			return nil, fmt.Errorf("'%s': %w", path, os.ErrNotExist)
+		}
+
+		node = nodes[idx]
+		nodes = node.Children
+	}
+
+	return node, nil
+}
+
+// children returns a pointer to the children of the folder `parentUUID`, or
+// to the top-level nodes if `parentUUID` is empty.
+func (t *PlaylistTree) children(parentUUID string) (*[]*PlaylistTreeNode, error) {
+	if parentUUID == "" {
+		return (*[]*PlaylistTreeNode)(t), nil
+	}
+
+	parent := t.Find(parentUUID)
+	if parent == nil {
+		return nil, fmt.Errorf("node '%s': %w", parentUUID, os.ErrNotExist)
+	} else if parent.Children == nil {
+		return nil, fmt.Errorf("node '%s': %w", parentUUID, ErrPlaylistNotFolder)
+	}
+	return &parent.Children, nil
+}
+
+// Insert adds `node` and its children at position `index` of the folder
+// `parentUUID`, or of the top-level if empty. An index of -1 appends it.
+func (t *PlaylistTree) Insert(parentUUID string, index int, node *PlaylistTreeNode) error {
+	if node == nil {
+		return errors.New("nil node")
+	}
+
+	// the UUIDs must be unique in the tree and in the inserted nodes
+	var dupErr error
+	seen := make(map[string]bool)
+	walkPlaylistTree([]*PlaylistTreeNode{node}, func(n *PlaylistTreeNode) {
+		if dupErr == nil && (seen[n.UUID] || t.Find(n.UUID) != nil) {
+			dupErr = fmt.Errorf("node '%s': %w", n.UUID, os.ErrExist)
+		}
+		seen[n.UUID] = true
+	})
+	if dupErr != nil {
+		return dupErr
+	}
+
+	siblings, err := t.children(parentUUID)
+	if err != nil {
+		return err
+	}
+
+	if index == -1 {
+		index = len(*siblings)
+	} else if index < 0 || index > len(*siblings) {
+		return fmt.Errorf("index %d out of range [0, %d]", index, len(*siblings))
+	}
+
+	*siblings = slices.Insert(*siblings, index, node)
+	return nil
+}
+
+// Delete removes the node of UUID `uuid` and its children, and returns it.
+func (t *PlaylistTree) Delete(uuid string) (*PlaylistTreeNode, error) {
+	var parentUUID string
+	if parent := t.parent(uuid); parent != nil {
+		parentUUID = parent.UUID
+	}
+
+	siblings, err := t.children(parentUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	idx := slices.IndexFunc(*siblings, func(n *PlaylistTreeNode) bool {
+		return n.UUID == uuid
+	})
+	if idx < 0 {
+		return nil, fmt.Errorf("node '%s': %w", uuid, os.ErrNotExist)
+	}
+
+	node := (*siblings)[idx]
+	*siblings = slices.Delete(*siblings, idx, idx+1)
+	return node, nil
+}
+
+// Move moves the node of UUID `uuid` to position `index` of the folder
+// `parentUUID`, or of the top-level if empty. The index is the one of the node
+// once moved; -1 appends it.
+func (t *PlaylistTree) Move(uuid string, parentUUID string, index int) error {
+	node := t.Find(uuid)
+	if node == nil {
+		return fmt.Errorf("node '%s': %w", uuid, os.ErrNotExist)
+	}
+
+	if parentUUID != "" && PlaylistTree(node.Children).Find(parentUUID) != nil || parentUUID == uuid {
+		return fmt.Errorf("unable to move node '%s' into itself", uuid)
+	}
+
+	// check the destination before detaching the node, which it may hold
+	siblings, err := t.children(parentUUID)
+	if err != nil {
+		return err
+	}
+	maxIndex := len(*siblings)
+	if slices.Contains(*siblings, node) {
+		maxIndex--
+	}
+	if index < -1 || index > maxIndex {
+		return fmt.Errorf("index %d out of range [0, %d]", index, maxIndex)
+	}
+
+	if _, err := t.Delete(uuid); err != nil {
+		return err
+	}
+	return t.Insert(parentUUID, index, node)
+}
+
+// Reorder moves the node of UUID `uuid` to position `index` among its
+// siblings. An index of -1 moves it last.
+func (t *PlaylistTree) Reorder(uuid string, index int) error {
+	var parentUUID string
+	if parent := t.parent(uuid); parent != nil {
+		parentUUID = parent.UUID
+	}
+
+	return t.Move(uuid, parentUUID, index)
+}
+
+// Rename sets the title of the node of UUID `uuid`.
+func (t PlaylistTree) Rename(uuid string, title string) error {
+	node := t.Find(uuid)
+	if node == nil {
+		return fmt.Errorf("node '%s': %w", uuid, os.ErrNotExist)
+	}
+
+	node.Title = title
+	return nil
+}
+
+// CheckPlaylistFavorite returns an error if a node of kind `kind` cannot be
+// marked as favorite. The Merlin lists its favorite tracks; folders of kind
+// PlaylistItemKindFolderFavorite are kept as found in `playlist.bin`, but what
+// the Merlin does with them is unknown, so only tracks can be marked.
+func CheckPlaylistFavorite(kind PlaylistItemKind) error {
+	if kind&PlaylistItemKindMask != PlaylistItemKindAudio {
+		return fmt.Errorf("%w, only tracks can be favorites", ErrPlaylistNotTrack)
+	}
+	return nil
+}
+
+// SetFavorite marks or unmarks the node of UUID `uuid` as favorite, as allowed
+// by CheckPlaylistFavorite. The order of a new favorite track is assigned by
+// FlattenPlaylistTree.
+func (t PlaylistTree) SetFavorite(uuid string, favorite bool) error {
+	node := t.Find(uuid)
+	if node == nil {
+		return fmt.Errorf("node '%s': %w", uuid, os.ErrNotExist)
+	}
+
+	kind := PlaylistItemKindAudio
+	if node.Children != nil {
+		kind = PlaylistItemKindFolder
+	}
+	if err := CheckPlaylistFavorite(kind); favorite && err != nil {
+		return fmt.Errorf("node '%s': %w", uuid, err)
+	}
+
+	node.Favorite = 0
+	if favorite {
+		node.Favorite = 1
+	} else {
+		node.FavoriteOrder = 0
+	}
+	return nil
+}
+
+// SetDiscover marks or unmarks the node of UUID `uuid` for discovery.
+func (t PlaylistTree) SetDiscover(uuid string, discover bool) error {
+	node := t.Find(uuid)
+	if node == nil {
+		return fmt.Errorf("node '%s': %w", uuid, os.ErrNotExist)
+	}
+
+	node.Discover = 0
+	if discover {
+		node.Discover = 1
+	}
+	return nil
+}
+
+// parent returns the folder holding the node of UUID `uuid`, or nil if it is
+// a top-level node or not found.
+func (t PlaylistTree) parent(uuid string) (parent *PlaylistTreeNode) {
+	walkPlaylistTree(t, func(n *PlaylistTreeNode) {
+		if parent == nil && slices.ContainsFunc(n.Children, func(c *PlaylistTreeNode) bool {
+			return c.UUID == uuid
+		}) {
+			parent = n
+		}
+	})
+	return
+}
+
+// walkPlaylistTree calls `fn` on every node, depth-first.
+func walkPlaylistTree(nodes []*PlaylistTreeNode, fn func(n *PlaylistTreeNode)) {
+	for _, node := range nodes {
+		fn(node)
+		walkPlaylistTree(node.Children, fn)
+	}
+}
@@ -0,0 +1,144 @@
+package pinpin
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testPlaylistTree is /F holding a, b and c, and /G holding g.
+func testPlaylistTree() PlaylistTree {
+	return PlaylistTree{
+		diffTestNode("F", diffTestNode("a"), diffTestNode("b"), diffTestNode("c")),
+		diffTestNode("G", diffTestNode("g")),
+	}
+}
+
+func playlistTreeUUIDs(nodes []*PlaylistTreeNode) (uuids []string) {
+	for _, node := range nodes {
+		uuids = append(uuids, node.UUID)
+	}
+	return
+}
+
+func TestPlaylistTreeMove(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		uuid   string
+		parent string
+		index  int
+		f, g   []string
+	}{
+		{"later", "a", "F", 2, []string{"b", "c", "a"}, []string{"g"}},
+		{"earlier", "c", "F", 0, []string{"c", "a", "b"}, []string{"g"}},
+		{"last", "b", "F", -1, []string{"a", "c", "b"}, []string{"g"}},
+		{"other folder", "b", "G", 0, []string{"a", "c"}, []string{"b", "g"}},
+		{"other folder last", "a", "G", -1, []string{"b", "c"}, []string{"g", "a"}},
+		{"other folder end", "a", "G", 1, []string{"b", "c"}, []string{"g", "a"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tree := testPlaylistTree()
+			require.NoError(t, tree.Move(tc.uuid, tc.parent, tc.index))
+			require.Equal(t, tc.f, playlistTreeUUIDs(tree.Find("F").Children))
+			require.Equal(t, tc.g, playlistTreeUUIDs(tree.Find("G").Children))
+		})
+	}
+}
+
+func TestPlaylistTreeMoveRejections(t *testing.T) {
+	tree := PlaylistTree{
+		diffTestNode("F", diffTestNode("E", diffTestNode("e"))),
+		diffTestNode("x"),
+	}
+
+	require.ErrorContains(t, tree.Move("F", "F", 0), "into itself")
+	require.ErrorContains(t, tree.Move("F", "E", 0), "into itself")
+	require.ErrorIs(t, tree.Move("missing", "", 0), os.ErrNotExist)
+	require.ErrorIs(t, tree.Move("e", "x", 0), ErrPlaylistNotFolder)
+	require.ErrorContains(t, tree.Move("e", "F", 3), "out of range")
+	// the index is the one once moved: the top-level still holds 2 nodes
+	require.ErrorContains(t, tree.Move("x", "", 2), "index 2 out of range [0, 1]")
+	require.ErrorContains(t, tree.Move("x", "", -2), "out of range")
+
+	// the tree is left untouched
+	require.Equal(t, []string{"F", "x"}, playlistTreeUUIDs(tree))
+	require.Equal(t, []string{"e"}, playlistTreeUUIDs(tree.Find("E").Children))
+}
+
+func TestPlaylistTreeLookup(t *testing.T) {
+	tree := testPlaylistTree()
+
+	for path, uuid := range map[string]string{
+		"/F":    "F",
+		"F/":    "F",
+		"/F/b":  "b",
+		"//G/g": "g",
+	} {
+		node, err := tree.Lookup(path)
+		require.NoError(t, err, path)
+		require.Equal(t, uuid, node.UUID, path)
+	}
+
+	// the root, whatever the slashes
+	for _, path := range []string{"/", "", "//"} {
+		root, err := tree.Lookup(path)
+		require.NoError(t, err, path)
+		require.Empty(t, root.UUID)
+		require.Equal(t, []string{"F", "G"}, playlistTreeUUIDs(root.Children))
+	}
+	root, err := PlaylistTree(nil).Lookup("/")
+	require.NoError(t, err)
+	require.NotNil(t, root.Children)
+
+	_, err = tree.Lookup("/F/d")
+	require.ErrorIs(t, err, os.ErrNotExist)
+	_, err = tree.Lookup("/F/a/b")
+	require.ErrorIs(t, err, ErrPlaylistNotFolder)
+	// not a node of empty title
+	root, err = PlaylistTree{{UUID: "untitled"}}.Lookup("/")
+	require.NoError(t, err)
+	require.Empty(t, root.UUID)
+	require.Equal(t, []string{"untitled"}, playlistTreeUUIDs(root.Children))
+}
+
+func TestPlaylistTreeInsert(t *testing.T) {
+	tree := testPlaylistTree()
+	require.NoError(t, tree.Insert("G", 0, diffTestNode("H", diffTestNode("h"))))
+	require.Equal(t, []string{"H", "g"}, playlistTreeUUIDs(tree.Find("G").Children))
+	require.NoError(t, tree.Insert("", -1, diffTestNode("I")))
+	require.Equal(t, []string{"F", "G", "I"}, playlistTreeUUIDs(tree))
+
+	// a UUID of the tree, or twice the same in the inserted nodes
+	require.ErrorIs(t, tree.Insert("", 0, diffTestNode("J", diffTestNode("b"))), os.ErrExist)
+	require.ErrorIs(t, tree.Insert("", 0, diffTestNode("J", diffTestNode("j"), diffTestNode("j"))), os.ErrExist)
+	require.ErrorIs(t, tree.Insert("", 0, diffTestNode("J", diffTestNode("J"))), os.ErrExist)
+
+	require.Error(t, tree.Insert("", 0, nil))
+	require.ErrorContains(t, tree.Insert("", 4, diffTestNode("J")), "out of range")
+	require.Nil(t, tree.Find("J"))
+}
+
+func TestPlaylistTreeSetFavorite(t *testing.T) {
+	tree := testPlaylistTree()
+	require.NoError(t, tree.SetFavorite("a", true))
+	require.Equal(t, 1, tree.Find("a").Favorite)
+
+	items, err := FlattenPlaylistTree(tree)
+	require.NoError(t, err)
+	require.Equal(t, "a", items[2].FileName)
+	require.Equal(t, uint16(1), items[2].FavoriteOrder)
+
+	require.NoError(t, tree.SetFavorite("a", false))
+	require.Zero(t, tree.Find("a").Favorite)
+	require.Zero(t, tree.Find("a").FavoriteOrder)
+
+	// folders cannot be favorites, but can be unmarked
+	require.ErrorIs(t, tree.SetFavorite("F", true), ErrPlaylistNotTrack)
+	require.Zero(t, tree.Find("F").Favorite)
+	tree.Find("G").Favorite = 1
+	require.NoError(t, tree.SetFavorite("G", false))
+	require.Zero(t, tree.Find("G").Favorite)
+
+	require.ErrorIs(t, tree.SetFavorite("missing", true), os.ErrNotExist)
+}
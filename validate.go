@@ -0,0 +1,230 @@
+package pinpin
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PlaylistMaxFavorites is the number of favorite tracks above which the
+// Merlin is assumed to refuse a playlist with ErrTooManyFavorite. The status
+// exists, but the limit was never observed on a device: exceeding it is only
+// a warning.
+const PlaylistMaxFavorites = 50
+
+var (
+	ErrPlaylistTruncated        = errors.New("truncated record")
+	ErrPlaylistRoot             = errors.New("invalid root")
+	ErrPlaylistDuplicateID      = errors.New("duplicate ID")
+	ErrPlaylistInvalidKind      = errors.New("invalid kind")
+	ErrPlaylistCycle            = errors.New("parent cycle")
+	ErrPlaylistOrphan           = errors.New("parent not found")
+	ErrPlaylistUnreachable      = errors.New("unreachable from root")
+	ErrPlaylistAudioChildren    = errors.New("audio with children")
+	ErrPlaylistChildrenCount    = errors.New("children count mismatch")
+	ErrPlaylistTooManyFavorites = errors.New("too many favorites")
+	ErrPlaylistFileNameTooLong  = errors.New("file name too long")
+	ErrPlaylistTitleTooLong     = errors.New("title too long")
+)
+
+// PlaylistIssue is a structural problem found in a playlist.
+type PlaylistIssue struct {
+	// Index is the position of the faulty item, or -1 if the issue is about
+	// the whole playlist.
+	Index int
+	ID    uint16
+	Err   error
+}
+
+func (i PlaylistIssue) Error() string {
+	if i.Index < 0 {
+		return i.Err.Error()
+	}
+	return fmt.Sprintf("item #%d (id %d): %s", i.Index, i.ID, i.Err.Error())
+}
+
+func (i PlaylistIssue) Unwrap() error {
+	return i.Err
+}
+
+// Fatal tells whether the Merlin would fail on the issue. The other issues
+// lose data, as the nodes are dropped or the titles truncated, but the
+// playlist remains usable, or are not known to fail, such as too many
+// favorites.
+func (i PlaylistIssue) Fatal() bool {
+	for _, err := range []error{ErrPlaylistOrphan, ErrPlaylistUnreachable, ErrPlaylistChildrenCount, ErrPlaylistTitleTooLong, ErrPlaylistTooManyFavorites} {
+		if errors.Is(i.Err, err) {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidatePlaylistBin decodes `playlist.bin` as far as possible and reports
+// the issues of its records as well as the ones of ValidatePlaylist.
+func ValidatePlaylistBin(buf []byte) []PlaylistIssue {
+	var items []PlaylistItem
+	var issues []PlaylistIssue
+
+	offset := 0
+	for ; offset+PlaylistItemSize <= len(buf); offset += PlaylistItemSize {
+		item, err := decodePlaylistRecord(buf[offset : offset+PlaylistItemSize])
+		if err != nil {
+			issues = append(issues, PlaylistIssue{Index: len(items), ID: item.ID, Err: err})
+		}
+		items = append(items, item)
+	}
+
+	issues = append(issues, ValidatePlaylist(items)...)
+
+	if offset < len(buf) {
+		issues = append(issues, PlaylistIssue{
+			Index: len(items),
+			Err:   fmt.Errorf("%w: %dB left at offset %d", ErrPlaylistTruncated, len(buf)-offset, offset),
+		})
+	}
+
+	return issues
+}
+
+type playlistReach int
+
+const (
+	reachUnknown playlistReach = iota
+	reachVisiting
+	reachRoot
+	reachCycle
+	reachOrphan
+	reachUnreachable
+)
+
+// ValidatePlaylist checks the structure of the playlist items: a single root,
+// unique IDs, every item reachable from the root and the limits of the
+// firmware.
+func ValidatePlaylist(items []PlaylistItem) []PlaylistIssue {
+	var issues []PlaylistIssue
+
+	byID := make(map[uint16]int, len(items))
+	children := make(map[uint16]int, len(items))
+	rootIdx := -1
+	for idx, item := range items {
+		if _, has := byID[item.ID]; has {
+			issues = append(issues, PlaylistIssue{idx, item.ID, fmt.Errorf("%w: %d", ErrPlaylistDuplicateID, item.ID)})
+		} else {
+			byID[item.ID] = idx
+		}
+
+		if item.Kind == PlaylistItemKindRoot {
+			if rootIdx >= 0 {
+				issues = append(issues, PlaylistIssue{idx, item.ID, fmt.Errorf("%w: another root is item #%d", ErrPlaylistRoot, rootIdx)})
+			} else {
+				rootIdx = idx
+			}
+		} else if item.ParentID != item.ID {
+			children[item.ParentID]++
+		}
+	}
+
+	if rootIdx < 0 {
+		issues = append(issues, PlaylistIssue{Index: -1, Err: fmt.Errorf("%w: no root", ErrPlaylistRoot)})
+	} else if root := items[rootIdx]; root.ParentID != root.ID {
+		// the root's parent is its descendant, or unreachable
+		if _, has := byID[root.ParentID]; has {
+			issues = append(issues, PlaylistIssue{rootIdx, root.ID, fmt.Errorf("%w: root has parent %d", ErrPlaylistCycle, root.ParentID)})
+		}
+	}
+
+	// follow the parents of each item up to the root
+	reach := make([]playlistReach, len(items))
+	for idx := range items {
+		var chain []int
+		cur, orphan := idx, false
+		for reach[cur] == reachUnknown && cur != rootIdx {
+			reach[cur] = reachVisiting
+			chain = append(chain, cur)
+
+			parentIdx, has := byID[items[cur].ParentID]
+			if !has {
+				orphan = true
+				break
+			}
+			cur = parentIdx
+		}
+
+		switch {
+		case cur == rootIdx:
+			reach[cur] = reachRoot
+			for _, chainIdx := range chain {
+				reach[chainIdx] = reachRoot
+			}
+		case orphan:
+			for _, chainIdx := range chain {
+				reach[chainIdx] = reachUnreachable
+			}
+			reach[cur] = reachOrphan
+		case reach[cur] == reachVisiting:
+			// the items up to `cur` only lead to the cycle
+			inCycle := false
+			for _, chainIdx := range chain {
+				inCycle = inCycle || chainIdx == cur
+				if inCycle {
+					reach[chainIdx] = reachCycle
+				} else {
+					reach[chainIdx] = reachUnreachable
+				}
+			}
+		default:
+			res := reachUnreachable
+			if reach[cur] == reachRoot {
+				res = reachRoot
+			}
+			for _, chainIdx := range chain {
+				reach[chainIdx] = res
+			}
+		}
+	}
+
+	var favorites int
+	for idx, item := range items {
+		issue := func(err error) {
+			issues = append(issues, PlaylistIssue{idx, item.ID, err})
+		}
+
+		kind := item.Kind & PlaylistItemKindMask
+		if item.Kind&^(PlaylistItemKindMask|PlaylistItemKindDiscoverMask) != 0 || (kind != PlaylistItemKindRoot && kind != PlaylistItemKindFolder && kind != PlaylistItemKindFolderFavorite && kind != PlaylistItemKindAudio) {
+			issue(fmt.Errorf("%w: 0x%.4x", ErrPlaylistInvalidKind, item.Kind))
+		}
+
+		switch reach[idx] {
+		case reachCycle:
+			issue(fmt.Errorf("%w: through parent %d", ErrPlaylistCycle, item.ParentID))
+		case reachOrphan:
+			issue(fmt.Errorf("%w: %d", ErrPlaylistOrphan, item.ParentID))
+		case reachUnreachable:
+			issue(fmt.Errorf("%w: through parent %d", ErrPlaylistUnreachable, item.ParentID))
+		}
+
+		if kind == PlaylistItemKindAudio && children[item.ID] > 0 {
+			issue(fmt.Errorf("%w: %d", ErrPlaylistAudioChildren, children[item.ID]))
+		}
+		if int(item.ChildrenCount) != children[item.ID] {
+			issue(fmt.Errorf("%w: %d declared, %d found", ErrPlaylistChildrenCount, item.ChildrenCount, children[item.ID]))
+		}
+
+		if len(item.FileName) > PlaylistFileNameMaxLen {
+			issue(fmt.Errorf("%w: '%s' is %dB long, max %dB", ErrPlaylistFileNameTooLong, item.FileName, len(item.FileName), PlaylistFileNameMaxLen))
+		}
+		if len(item.Title) > PlaylistTitleMaxLen {
+			issue(fmt.Errorf("%w: '%s' is %dB long, max %dB", ErrPlaylistTitleTooLong, item.Title, len(item.Title), PlaylistTitleMaxLen))
+		}
+
+		if kind == PlaylistItemKindAudio && item.FavoriteOrder != 0 {
+			favorites++
+		}
+	}
+
+	if favorites > PlaylistMaxFavorites {
+		issues = append(issues, PlaylistIssue{Index: -1, Err: fmt.Errorf("%w: %d, max %d", ErrPlaylistTooManyFavorites, favorites, PlaylistMaxFavorites)})
+	}
+
+	return issues
+}
@@ -0,0 +1,234 @@
+package pinpin
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func requirePlaylistIssue(t *testing.T, issues []PlaylistIssue, target error, id uint16) PlaylistIssue {
+	t.Helper()
+
+	for _, issue := range issues {
+		if errors.Is(issue, target) && issue.ID == id {
+			return issue
+		}
+	}
+	t.Fatalf("no '%s' issue for item %d in %v", target, id, issues)
+	return PlaylistIssue{}
+}
+
+func TestValidatePlaylist(t *testing.T) {
+	require.Empty(t, ValidatePlaylist(testPlaylistItems()))
+
+	items := testPlaylistItems()
+	items[2].ParentID = 42
+	requirePlaylistIssue(t, ValidatePlaylist(items), ErrPlaylistOrphan, 3)
+
+	items = testPlaylistItems()
+	items = append(items, PlaylistItem{ID: 6, ParentID: 7, Kind: PlaylistItemKindFolder}, PlaylistItem{ID: 7, ParentID: 6, Kind: PlaylistItemKindFolder})
+	issues := ValidatePlaylist(items)
+	requirePlaylistIssue(t, issues, ErrPlaylistCycle, 6)
+	requirePlaylistIssue(t, issues, ErrPlaylistCycle, 7)
+
+	items = testPlaylistItems()
+	items[4].ID = 2
+	requirePlaylistIssue(t, ValidatePlaylist(items), ErrPlaylistDuplicateID, 2)
+}
+
+func TestPlaylistRootWithParent(t *testing.T) {
+	items := []PlaylistItem{
+		{ID: 1, ParentID: 2, Kind: PlaylistItemKindRoot, ChildrenCount: 1},
+		{ID: 2, ParentID: 1, Kind: PlaylistItemKindFolder, FileName: "folder", Title: "Contes"},
+	}
+
+	issues := ValidatePlaylist(items)
+	requirePlaylistIssue(t, issues, ErrPlaylistCycle, 1)
+	require.True(t, issues[0].Fatal())
+
+	// the tree is still built, without looping through the root
+	nodes, err := BuildPlaylistTree(items)
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	require.Equal(t, "folder", nodes[0].UUID)
+	require.Empty(t, nodes[0].Children)
+}
+
+func TestValidatePlaylistTooManyFavorites(t *testing.T) {
+	items := []PlaylistItem{{ID: 1, Kind: PlaylistItemKindRoot, ChildrenCount: PlaylistMaxFavorites + 1}}
+	for idx := range PlaylistMaxFavorites + 1 {
+		items = append(items, PlaylistItem{ID: uint16(idx + 2), ParentID: 1, Order: uint16(idx), Kind: PlaylistItemKindAudio, FavoriteOrder: uint16(idx + 1)})
+	}
+
+	// the limit is assumed, the playlist is still synced
+	issues := ValidatePlaylist(items)
+	require.Len(t, issues, 1)
+	require.ErrorIs(t, issues[0], ErrPlaylistTooManyFavorites)
+	require.False(t, issues[0].Fatal())
+}
+
+func TestValidatePlaylistBin(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		items func(items []PlaylistItem) []PlaylistItem
+		buf   func(buf []byte) []byte
+		err   error
+		id    uint16
+		fatal bool
+	}{
+		{
+			name:  "trailing partial record",
+			buf:   func(buf []byte) []byte { return append(buf, make([]byte, 10)...) },
+			err:   ErrPlaylistTruncated,
+			fatal: true,
+		},
+		{
+			name:  "no root",
+			items: func(items []PlaylistItem) []PlaylistItem { return items[1:] },
+			err:   ErrPlaylistRoot,
+			fatal: true,
+		},
+		{
+			name: "multiple roots",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				items[4].Kind = PlaylistItemKindRoot
+				return items
+			},
+			err:   ErrPlaylistRoot,
+			id:    5,
+			fatal: true,
+		},
+		{
+			name: "duplicate ID",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				items[4].ID = 2
+				return items
+			},
+			err:   ErrPlaylistDuplicateID,
+			id:    2,
+			fatal: true,
+		},
+		{
+			name: "invalid kind",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				items[2].Kind = 0x0003
+				return items
+			},
+			err:   ErrPlaylistInvalidKind,
+			id:    3,
+			fatal: true,
+		},
+		{
+			name: "cycle",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				items[0].ParentID = 2
+				return items
+			},
+			err:   ErrPlaylistCycle,
+			id:    1,
+			fatal: true,
+		},
+		{
+			name: "orphan",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				items[2].ParentID = 42
+				return items
+			},
+			err:   ErrPlaylistOrphan,
+			id:    3,
+			fatal: false,
+		},
+		{
+			name: "unreachable",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				return append(items,
+					PlaylistItem{ID: 6, ParentID: 42, Kind: PlaylistItemKindFolder, ChildrenCount: 1},
+					PlaylistItem{ID: 7, ParentID: 6, Kind: PlaylistItemKindAudio})
+			},
+			err:   ErrPlaylistUnreachable,
+			id:    7,
+			fatal: false,
+		},
+		{
+			name: "audio with children",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				items[0].ChildrenCount = 1
+				items[2].ChildrenCount = 1
+				items[4].ParentID = 3
+				return items
+			},
+			err:   ErrPlaylistAudioChildren,
+			id:    3,
+			fatal: true,
+		},
+		{
+			name: "children count mismatch",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				items[0].ChildrenCount = 3
+				return items
+			},
+			err:   ErrPlaylistChildrenCount,
+			id:    1,
+			fatal: false,
+		},
+		{
+			name: "too many favorites",
+			items: func(items []PlaylistItem) []PlaylistItem {
+				items[1].ChildrenCount += PlaylistMaxFavorites
+				for idx := range PlaylistMaxFavorites {
+					items = append(items, PlaylistItem{ID: uint16(idx + 6), ParentID: 2, Order: uint16(idx + 2), Kind: PlaylistItemKindAudio, FavoriteOrder: uint16(idx + 2)})
+				}
+				return items
+			},
+			err:   ErrPlaylistTooManyFavorites,
+			fatal: false,
+		},
+		{
+			name: "file name too long",
+			buf: func(buf []byte) []byte {
+				buf[2*PlaylistItemSize+20] = PlaylistFileNameMaxLen + 1
+				return buf
+			},
+			err:   ErrPlaylistFileNameTooLong,
+			id:    3,
+			fatal: true,
+		},
+		{
+			name: "title too long",
+			buf: func(buf []byte) []byte {
+				buf[2*PlaylistItemSize+85] = PlaylistTitleMaxLen + 1
+				return buf
+			},
+			err:   ErrPlaylistTitleTooLong,
+			id:    3,
+			fatal: false,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			items := testPlaylistItems()
+			if tc.items != nil {
+				items = tc.items(items)
+			}
+			buf, err := EncodePlaylistBin(items)
+			require.NoError(t, err)
+			if tc.buf != nil {
+				buf = tc.buf(buf)
+			}
+
+			issue := requirePlaylistIssue(t, ValidatePlaylistBin(buf), tc.err, tc.id)
+			require.Equal(t, tc.fatal, issue.Fatal(), issue.Error())
+		})
+	}
+
+	buf, err := EncodePlaylistBin(testPlaylistItems())
+	require.NoError(t, err)
+	require.Empty(t, ValidatePlaylistBin(buf))
+
+	// the records before a partial one are still validated
+	issues := ValidatePlaylistBin(buf[:len(buf)-1])
+	require.Len(t, issues, 2)
+	requirePlaylistIssue(t, issues, ErrPlaylistChildrenCount, 1)
+	require.Equal(t, PlaylistIssue{Index: 4, Err: issues[1].Err}, issues[1])
+	require.ErrorIs(t, issues[1], ErrPlaylistTruncated)
+}